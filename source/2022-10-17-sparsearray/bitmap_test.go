@@ -0,0 +1,566 @@
+package vectest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/akmistry/go-util/bitmap"
+)
+
+// Helpers for bitmap.Bitmap256, which lives in go-util and so can't have
+// methods added here. Bit i is stored in word i>>6, at bit position i&63.
+//
+// Bitmap256 is defined as [4]uint64, so code wanting to work on the raw words
+// can convert directly with [4]uint64(bm) and bitmap.Bitmap256(words).
+
+// BitmapOr returns the union of a and b.
+func BitmapOr(a, b bitmap.Bitmap256) bitmap.Bitmap256 {
+	for i := range a {
+		a[i] |= b[i]
+	}
+	return a
+}
+
+// BitmapAnd returns the intersection of a and b.
+func BitmapAnd(a, b bitmap.Bitmap256) bitmap.Bitmap256 {
+	for i := range a {
+		a[i] &= b[i]
+	}
+	return a
+}
+
+// BitmapAndNot returns the bits set in a but not in b.
+func BitmapAndNot(a, b bitmap.Bitmap256) bitmap.Bitmap256 {
+	for i := range a {
+		a[i] &^= b[i]
+	}
+	return a
+}
+
+// BitmapOrWith sets dst to the union of dst and other, in place.
+func BitmapOrWith(dst *bitmap.Bitmap256, other bitmap.Bitmap256) {
+	for i := range dst {
+		dst[i] |= other[i]
+	}
+}
+
+// BitmapAndWith sets dst to the intersection of dst and other, in place.
+func BitmapAndWith(dst *bitmap.Bitmap256, other bitmap.Bitmap256) {
+	for i := range dst {
+		dst[i] &= other[i]
+	}
+}
+
+// BitmapSetRange sets the bits in [lo, hi), in place, a word at a time.
+func BitmapSetRange(bm *bitmap.Bitmap256, lo, hi int) {
+	for w := lo >> 6; w < len(bm) && w<<6 < hi; w++ {
+		mask := ^uint64(0)
+		if start := w << 6; lo > start {
+			mask <<= uint(lo - start)
+		}
+		if end := (w + 1) << 6; hi < end {
+			mask &^= ^uint64(0) << uint(hi-w<<6)
+		}
+		bm[w] |= mask
+	}
+}
+
+// BitmapInvert returns the complement of bm.
+func BitmapInvert(bm bitmap.Bitmap256) bitmap.Bitmap256 {
+	for i := range bm {
+		bm[i] = ^bm[i]
+	}
+	return bm
+}
+
+// BitmapIntersects returns true if a and b have any set bit in common,
+// returning as soon as a common word is found.
+func BitmapIntersects(a, b bitmap.Bitmap256) bool {
+	for i := range a {
+		if a[i]&b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// BitmapDelta returns the bits set in newBm but not oldBm (newlySet), and the
+// bits set in oldBm but not newBm (newlyCleared).
+func BitmapDelta(oldBm, newBm bitmap.Bitmap256) (newlySet, newlyCleared bitmap.Bitmap256) {
+	for i := range oldBm {
+		changed := oldBm[i] ^ newBm[i]
+		newlySet[i] = changed & newBm[i]
+		newlyCleared[i] = changed & oldBm[i]
+	}
+	return
+}
+
+// bitmapForEach calls f with the position of each set bit in ascending order,
+// stopping if f returns false.
+func bitmapForEach(bm *bitmap.Bitmap256, f func(i uint8) bool) {
+	for w, word := range bm {
+		for word != 0 {
+			if !f(uint8(w<<6 + bits.TrailingZeros64(word))) {
+				return
+			}
+			word &= word - 1
+		}
+	}
+}
+
+// BitmapCountLessEqual returns the number of set bits in [0, i], including i
+// itself. This differs from bm.CountLess(i), which counts [0, i) and so gives
+// the position of i in a values slice, rather than the length of the slice up
+// to and including i.
+func BitmapCountLessEqual(bm *bitmap.Bitmap256, i uint8) int {
+	w := int(i >> 6)
+	// Bits [0, i&63] of the word: the complement of BitmapNextSet's mask.
+	n := bits.OnesCount64(bm[w] &^ (^uint64(0) << (i & 63) << 1))
+	for _, word := range bm[:w] {
+		n += bits.OnesCount64(word)
+	}
+	return n
+}
+
+// BitmapNextSet returns the smallest set bit greater than i, if any.
+func BitmapNextSet(bm *bitmap.Bitmap256, i uint8) (uint8, bool) {
+	w := int(i >> 6)
+	// Two shifts, since shifting by 64 (when i&63 == 63) clears every bit.
+	word := bm[w] & (^uint64(0) << (i & 63) << 1)
+	for {
+		if word != 0 {
+			return uint8(w<<6 + bits.TrailingZeros64(word)), true
+		}
+		w++
+		if w == len(bm) {
+			return 0, false
+		}
+		word = bm[w]
+	}
+}
+
+// BitmapPrevSet returns the largest set bit less than i, if any.
+func BitmapPrevSet(bm *bitmap.Bitmap256, i uint8) (uint8, bool) {
+	w := int(i >> 6)
+	word := bm[w] & (uint64(1)<<(i&63) - 1)
+	for {
+		if word != 0 {
+			return uint8(w<<6 + 63 - bits.LeadingZeros64(word)), true
+		}
+		w--
+		if w < 0 {
+			return 0, false
+		}
+		word = bm[w]
+	}
+}
+
+// BitmapBytes returns the 32-byte little-endian encoding of bm.
+func BitmapBytes(bm *bitmap.Bitmap256) []byte {
+	b := make([]byte, 32)
+	for i, w := range bm {
+		binary.LittleEndian.PutUint64(b[i*8:], w)
+	}
+	return b
+}
+
+// BitmapString formats bm for debugging, as its 32 bytes in hex in
+// BitmapBytes order (so byte n holds bits [8n, 8n+8)), followed by the set
+// indices in brackets.
+func BitmapString(bm *bitmap.Bitmap256) string {
+	var sb strings.Builder
+	for n, b := range BitmapBytes(bm) {
+		if n > 0 {
+			sb.WriteByte(' ')
+		}
+		fmt.Fprintf(&sb, "%02x", b)
+	}
+	sb.WriteString(" [")
+	first := true
+	bitmapForEach(bm, func(i uint8) bool {
+		if !first {
+			sb.WriteByte(' ')
+		}
+		first = false
+		fmt.Fprintf(&sb, "%d", i)
+		return true
+	})
+	sb.WriteByte(']')
+	return sb.String()
+}
+
+const (
+	bitmapModeRaw   = 0
+	bitmapModeIndex = 1
+)
+
+var errBadBitmapEncoding = errors.New("vectest: invalid bitmap encoding")
+
+// BitmapCompressedBytes encodes bm as a 1-byte mode tag followed by either the
+// raw 32-byte bitmap, or the list of set indices if that is smaller.
+func BitmapCompressedBytes(bm *bitmap.Bitmap256) []byte {
+	count := bm.Count()
+	if count >= 32 {
+		return append([]byte{bitmapModeRaw}, BitmapBytes(bm)...)
+	}
+	b := make([]byte, 1, 1+count)
+	b[0] = bitmapModeIndex
+	bitmapForEach(bm, func(i uint8) bool {
+		b = append(b, i)
+		return true
+	})
+	return b
+}
+
+// ParseCompressedBitmap decodes the output of BitmapCompressedBytes.
+func ParseCompressedBitmap(b []byte) (bitmap.Bitmap256, error) {
+	var bm bitmap.Bitmap256
+	if len(b) == 0 {
+		return bm, errBadBitmapEncoding
+	}
+	switch b[0] {
+	case bitmapModeRaw:
+		if len(b) != 33 {
+			return bm, errBadBitmapEncoding
+		}
+		for i := range bm {
+			bm[i] = binary.LittleEndian.Uint64(b[1+i*8:])
+		}
+	case bitmapModeIndex:
+		for _, i := range b[1:] {
+			bm.Set(i)
+		}
+	default:
+		return bm, errBadBitmapEncoding
+	}
+	return bm, nil
+}
+
+func TestBitmapCompressedBytes(t *testing.T) {
+	var full bitmap.Bitmap256
+	for i := 0; i < 256; i++ {
+		full.Set(uint8(i))
+	}
+	var sparse, dense bitmap.Bitmap256
+	for i := 0; i < 256; i += 37 {
+		sparse.Set(uint8(i))
+	}
+	for i := 0; i < 256; i += 3 {
+		dense.Set(uint8(i))
+	}
+
+	cases := []struct {
+		name    string
+		bm      bitmap.Bitmap256
+		encSize int
+	}{
+		{"Empty", bitmap.Bitmap256{}, 1},
+		{"Sparse", sparse, 1 + sparse.Count()},
+		{"Dense", dense, 33},
+		{"Full", full, 33},
+	}
+	for _, c := range cases {
+		b := BitmapCompressedBytes(&c.bm)
+		if len(b) != c.encSize {
+			t.Errorf("%s: Encoded size %d != expected %d", c.name, len(b), c.encSize)
+		}
+		bm, err := ParseCompressedBitmap(b)
+		if err != nil {
+			t.Errorf("%s: ParseCompressedBitmap error: %v", c.name, err)
+		} else if bm != c.bm {
+			t.Errorf("%s: Decoded %x != expected %x", c.name, bm, c.bm)
+		}
+	}
+
+	for _, b := range [][]byte{nil, {bitmapModeRaw, 1, 2}, {2}} {
+		if _, err := ParseCompressedBitmap(b); err == nil {
+			t.Errorf("ParseCompressedBitmap(%v) expected error", b)
+		}
+	}
+}
+
+func TestBitmapWordLayout(t *testing.T) {
+	for n := 0; n < 100; n++ {
+		words := [4]uint64{rand.Uint64(), rand.Uint64(), rand.Uint64(), rand.Uint64()}
+		bm := bitmap.Bitmap256(words)
+		if [4]uint64(bm) != words {
+			t.Fatalf("Round trip %x != expected %x", [4]uint64(bm), words)
+		}
+		for i := 0; i < 256; i++ {
+			want := (words[i>>6]>>(i&63))&1 == 1
+			if bm.Get(uint8(i)) != want {
+				t.Errorf("Get(%d) %v != word bit %v", i, bm.Get(uint8(i)), want)
+			}
+		}
+	}
+}
+
+func randomBitmap() bitmap.Bitmap256 {
+	return bitmap.Bitmap256{rand.Uint64(), rand.Uint64(), rand.Uint64(), rand.Uint64()}
+}
+
+func TestBitmapDelta(t *testing.T) {
+	for n := 0; n < 100; n++ {
+		oldBm, newBm := randomBitmap(), randomBitmap()
+		if n == 0 {
+			newBm = oldBm
+		}
+		set, cleared := BitmapDelta(oldBm, newBm)
+		for i := 0; i < 256; i++ {
+			o, b := oldBm.Get(uint8(i)), newBm.Get(uint8(i))
+			if set.Get(uint8(i)) != (b && !o) {
+				t.Errorf("newlySet bit %d %v, old %v new %v", i, set.Get(uint8(i)), o, b)
+			}
+			if cleared.Get(uint8(i)) != (o && !b) {
+				t.Errorf("newlyCleared bit %d %v, old %v new %v", i, cleared.Get(uint8(i)), o, b)
+			}
+		}
+	}
+}
+
+func TestBitmapIntersects(t *testing.T) {
+	var empty, low, high, lowAndHigh bitmap.Bitmap256
+	low.Set(3)
+	high.Set(200)
+	lowAndHigh.Set(3)
+	lowAndHigh.Set(255)
+
+	cases := []struct {
+		name string
+		a, b bitmap.Bitmap256
+		want bool
+	}{
+		{"BothEmpty", empty, empty, false},
+		{"OneEmpty", empty, lowAndHigh, false},
+		{"Disjoint", low, high, false},
+		{"Overlapping", low, lowAndHigh, true},
+		{"Identical", high, high, true},
+	}
+	for _, c := range cases {
+		if got := BitmapIntersects(c.a, c.b); got != c.want {
+			t.Errorf("%s: BitmapIntersects %v != expected %v", c.name, got, c.want)
+		}
+		if got := BitmapIntersects(c.b, c.a); got != c.want {
+			t.Errorf("%s: Reversed BitmapIntersects %v != expected %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestBitmapNextPrevSet(t *testing.T) {
+	var sparse bitmap.Bitmap256
+	sparse.Set(0)
+	sparse.Set(64)
+	sparse.Set(255)
+	bitmaps := []bitmap.Bitmap256{{}, sparse}
+	for n := 0; n < 20; n++ {
+		bm := randomBitmap()
+		// Clear some whole words to exercise the word scans.
+		bm[rand.Intn(4)] = 0
+		bm[rand.Intn(4)] = 0
+		bitmaps = append(bitmaps, bm)
+	}
+
+	for _, bm := range bitmaps {
+		for i := 0; i < 256; i++ {
+			next, nextOk := 0, false
+			for j := i + 1; j < 256; j++ {
+				if bm.Get(uint8(j)) {
+					next, nextOk = j, true
+					break
+				}
+			}
+			prev, prevOk := 0, false
+			for j := i - 1; j >= 0; j-- {
+				if bm.Get(uint8(j)) {
+					prev, prevOk = j, true
+					break
+				}
+			}
+
+			if got, ok := BitmapNextSet(&bm, uint8(i)); int(got) != next || ok != nextOk {
+				t.Errorf("%x: NextSet(%d) (%d, %v) != expected (%d, %v)", bm, i, got, ok, next, nextOk)
+			}
+			if got, ok := BitmapPrevSet(&bm, uint8(i)); int(got) != prev || ok != prevOk {
+				t.Errorf("%x: PrevSet(%d) (%d, %v) != expected (%d, %v)", bm, i, got, ok, prev, prevOk)
+			}
+		}
+	}
+}
+
+func TestBitmapCountLessEqual(t *testing.T) {
+	var full bitmap.Bitmap256
+	for i := 0; i < 256; i++ {
+		full.Set(uint8(i))
+	}
+	for _, bm := range []bitmap.Bitmap256{{}, full, randomBitmap(), randomBitmap()} {
+		for i := 0; i < 256; i++ {
+			expected := bm.CountLess(uint8(i))
+			if bm.Get(uint8(i)) {
+				expected++
+			}
+			if got := BitmapCountLessEqual(&bm, uint8(i)); got != expected {
+				t.Errorf("%x: CountLessEqual(%d) %d != expected %d", bm, i, got, expected)
+			}
+		}
+	}
+}
+
+func TestBitmapInvert(t *testing.T) {
+	var full bitmap.Bitmap256
+	for i := 0; i < 256; i++ {
+		full.Set(uint8(i))
+	}
+	if BitmapInvert(bitmap.Bitmap256{}) != full {
+		t.Errorf("Inverted empty bitmap %x != full", BitmapInvert(bitmap.Bitmap256{}))
+	}
+	for n := 0; n < 20; n++ {
+		bm := randomBitmap()
+		inv := BitmapInvert(bm)
+		if BitmapInvert(inv) != bm {
+			t.Errorf("%x: Inverted twice %x", bm, BitmapInvert(inv))
+		}
+		if inv.Count() != 256-bm.Count() {
+			t.Errorf("%x: Inverted count %d != expected %d", bm, inv.Count(), 256-bm.Count())
+		}
+		if BitmapIntersects(bm, inv) {
+			t.Errorf("%x: Intersects its inverse", bm)
+		}
+	}
+}
+
+func TestBitmapInPlace(t *testing.T) {
+	for n := 0; n < 100; n++ {
+		a, b := randomBitmap(), randomBitmap()
+		or, and := a, a
+		BitmapOrWith(&or, b)
+		BitmapAndWith(&and, b)
+		if or != BitmapOr(a, b) {
+			t.Errorf("%x | %x: OrWith %x != Or %x", a, b, or, BitmapOr(a, b))
+		}
+		if and != BitmapAnd(a, b) {
+			t.Errorf("%x & %x: AndWith %x != And %x", a, b, and, BitmapAnd(a, b))
+		}
+		if andNot := BitmapAndNot(a, b); andNot != BitmapAnd(a, BitmapInvert(b)) {
+			t.Errorf("%x &^ %x: AndNot %x != And with inverse", a, b, andNot)
+		}
+		for i := 0; i < 256; i++ {
+			if and.Get(uint8(i)) != (a.Get(uint8(i)) && b.Get(uint8(i))) {
+				t.Errorf("%x & %x: bit %d %v", a, b, i, and.Get(uint8(i)))
+			}
+		}
+	}
+}
+
+func TestBitmapString(t *testing.T) {
+	var bm bitmap.Bitmap256
+	for _, i := range []uint8{0, 3, 9, 64, 255} {
+		bm.Set(i)
+	}
+	expected := "09 02 00 00 00 00 00 00 01 00 00 00 00 00 00 00 " +
+		"00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 80 [0 3 9 64 255]"
+	if s := BitmapString(&bm); s != expected {
+		t.Errorf("BitmapString %q != expected %q", s, expected)
+	}
+
+	bm = bitmap.Bitmap256{}
+	if s := BitmapString(&bm); s != strings.Repeat("00 ", 32)+"[]" {
+		t.Errorf("BitmapString of empty bitmap %q", s)
+	}
+}
+
+// Alternative CountLess implementations, for BenchmarkCountLess. go-util uses
+// the switch on amd64, and countLessPrefix on arm64.
+
+// countLessNaive tests each bit below pos individually.
+func countLessNaive(bm *bitmap.Bitmap256, pos uint8) int {
+	n := 0
+	for i := 0; i < int(pos); i++ {
+		if bm.Get(uint8(i)) {
+			n++
+		}
+	}
+	return n
+}
+
+// countLessLoop popcounts the words below pos in a loop, then the partial word.
+func countLessLoop(bm *bitmap.Bitmap256, pos uint8) int {
+	w := int(pos >> 6)
+	n := bits.OnesCount64(bm[w] & (uint64(1)<<(pos&63) - 1))
+	for _, word := range bm[:w] {
+		n += bits.OnesCount64(word)
+	}
+	return n
+}
+
+// countLessPrefix popcounts every full word into a prefix sum array, and
+// indexes it, which avoids a data-dependent branch.
+func countLessPrefix(bm *bitmap.Bitmap256, pos uint8) int {
+	w := int(pos >> 6)
+	var before [4]int
+	before[1] = bits.OnesCount64(bm[0])
+	before[2] = before[1] + bits.OnesCount64(bm[1])
+	before[3] = before[2] + bits.OnesCount64(bm[2])
+	return before[w] + bits.OnesCount64(bm[w]&(uint64(1)<<(pos&63)-1))
+}
+
+var countLessImpls = []struct {
+	name string
+	f    func(bm *bitmap.Bitmap256, pos uint8) int
+}{
+	{"Bitmap256", (*bitmap.Bitmap256).CountLess},
+	{"Naive", countLessNaive},
+	{"Loop", countLessLoop},
+	{"Prefix", countLessPrefix},
+}
+
+func TestCountLessImpls(t *testing.T) {
+	bm := randomBitmap()
+	for _, impl := range countLessImpls {
+		for i := 0; i < 256; i++ {
+			if c, e := impl.f(&bm, uint8(i)), bm.CountLess(uint8(i)); c != e {
+				t.Errorf("%s: CountLess(%d) %d != expected %d", impl.name, i, c, e)
+			}
+		}
+	}
+}
+
+var countLessSink int
+
+// BenchmarkCountLess measures CountLess, which every BitmapArray Put and Get
+// calls, on a half-full bitmap at uniformly random positions.
+func BenchmarkCountLess(b *testing.B) {
+	rng := rand.New(rand.NewSource(*dataSeed))
+	bm := bitmap.Bitmap256{rng.Uint64(), rng.Uint64(), rng.Uint64(), rng.Uint64()}
+	positions := make([]uint8, 1024)
+	for i := range positions {
+		positions[i] = uint8(rng.Intn(256))
+	}
+	for _, impl := range countLessImpls {
+		b.Run(impl.name, func(b *testing.B) {
+			n := 0
+			for i := 0; i < b.N; i++ {
+				n += impl.f(&bm, positions[i&(len(positions)-1)])
+			}
+			countLessSink = n
+		})
+	}
+}
+
+func TestBitmapSetRange(t *testing.T) {
+	for _, r := range [][2]int{{0, 0}, {0, 256}, {3, 4}, {10, 64}, {64, 128}, {60, 70}, {1, 255}, {200, 256}} {
+		bm := randomBitmap()
+		orig := bm
+		BitmapSetRange(&bm, r[0], r[1])
+		for i := 0; i < 256; i++ {
+			expected := orig.Get(uint8(i)) || (i >= r[0] && i < r[1])
+			if bm.Get(uint8(i)) != expected {
+				t.Errorf("SetRange(%d, %d): bit %d %v != expected %v", r[0], r[1], i, bm.Get(uint8(i)), expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package vectest
+
+import (
+	"bytes"
+	"testing"
+)
+
+// BlockCounter wraps a block allocator, counting the blocks which are live:
+// held by a counted vector, and not yet freed. Blocks are counted when they
+// are allocated, or when a vector takes on a block from elsewhere, such as a
+// clone in Copy, a decoded block in ReadFrom or a FrozenArray from Freeze.
+// They are uncounted when a vector drops them, as in Sweep, Freeze, ReadFrom
+// or shrinking. A count that keeps growing in a long-running service suggests
+// a block leak.
+type BlockCounter struct {
+	alloc func() Sparse256Array
+	live  int
+}
+
+func NewBlockCounter(allocArray func() Sparse256Array) *BlockCounter {
+	return &BlockCounter{alloc: allocArray}
+}
+
+// Alloc allocates a block, counting it as live.
+func (c *BlockCounter) Alloc() Sparse256Array {
+	c.live++
+	return c.alloc()
+}
+
+func (c *BlockCounter) adopt(Sparse256Array) {
+	c.live++
+}
+
+func (c *BlockCounter) free(Sparse256Array) {
+	c.live--
+}
+
+// LiveBlocks returns the number of blocks allocated or adopted, and not yet
+// freed.
+func (c *BlockCounter) LiveBlocks() int {
+	return c.live
+}
+
+// NewCountedSparseishVector returns a vector with every block unallocated,
+// which allocates blocks from c and reports adopted and freed blocks to it.
+// Vectors derived from it, such as by Copy or Slice, report to c too.
+func NewCountedSparseishVector(length int, c *BlockCounter) *SparseishVector {
+	v := newLazySparseishVector(length, c.Alloc)
+	v.free, v.adopt = c.free, c.adopt
+	return v
+}
+
+// countBlocks returns the number of allocated blocks in v.
+func countBlocks(v *SparseishVector) int {
+	n := 0
+	for _, b := range v.blocks {
+		if b != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func TestBlockCounter(t *testing.T) {
+	const numBlocks = 20
+	for _, at := range arrayTypes {
+		c := NewBlockCounter(at.alloc)
+		v := NewCountedSparseishVector(numBlocks*blockSize, c)
+		if c.LiveBlocks() != 0 {
+			t.Errorf("%s: LiveBlocks %d for lazy vector != expected 0", at.name, c.LiveBlocks())
+		}
+
+		keys := generateTestData(*dataSeed, 100, numBlocks*blockSize)
+		allocated := make(map[int]bool)
+		for _, k := range keys {
+			v.Put(k, k)
+			allocated[k>>blockBits] = true
+		}
+		if c.LiveBlocks() != len(allocated) {
+			t.Errorf("%s: LiveBlocks %d != expected %d", at.name, c.LiveBlocks(), len(allocated))
+		}
+
+		for _, k := range keys {
+			v.Put(k, nil)
+		}
+		if freed := v.Sweep(); freed != len(allocated) {
+			t.Errorf("%s: Sweep freed %d blocks != expected %d", at.name, freed, len(allocated))
+		}
+		if c.LiveBlocks() != 0 {
+			t.Errorf("%s: LiveBlocks %d after Sweep != expected 0", at.name, c.LiveBlocks())
+		}
+
+		// Freezing replaces the allocated blocks with adopted FrozenArrays,
+		// and frees the empty one.
+		v.Put(5, 5)
+		v.Put(5*blockSize, 5)
+		v.Put(9*blockSize, 9)
+		v.Put(9*blockSize, nil)
+		v.Freeze()
+		if c.LiveBlocks() != 2 {
+			t.Errorf("%s: LiveBlocks %d after Freeze != expected 2", at.name, c.LiveBlocks())
+		}
+	}
+}
+
+// TestBlockCounterDerived checks the count through the paths which replace,
+// drop or copy blocks other than by Put and Sweep.
+func TestBlockCounterDerived(t *testing.T) {
+	const numBlocks = 20
+	for _, at := range arrayTypes {
+		c := NewBlockCounter(at.alloc)
+		v := NewCountedSparseishVector(numBlocks*blockSize, c)
+		for _, k := range generateTestData(*dataSeed, 200, numBlocks*blockSize) {
+			v.Put(k, k)
+		}
+		v.Put(3, 3)
+		v.Put((numBlocks-1)*blockSize, 1)
+		checkLive := func(what string, vectors ...*SparseishVector) {
+			t.Helper()
+			expected := 0
+			for _, v := range vectors {
+				expected += countBlocks(v)
+			}
+			if c.LiveBlocks() != expected {
+				t.Errorf("%s: LiveBlocks %d after %s != expected %d", at.name, c.LiveBlocks(), what, expected)
+			}
+		}
+
+		s := v.Slice(blockSize/2, 7*blockSize)
+		cp := v.Copy()
+		f := v.Filter(func(i int, _ interface{}) bool { return i%2 == 0 })
+		m := v.MapCopy(func(_ int, val interface{}) interface{} { return val })
+		checkLive("Slice, Copy, Filter and MapCopy", v, s, cp, f, m)
+
+		// Shrinking drops the blocks past the new length.
+		cp.resize(5*blockSize + 1)
+		checkLive("resize", v, s, cp, f, m)
+
+		// Read a stream of mixed block types, which replaces some blocks with
+		// decoded blocks of another type, and drops the unwritten ones.
+		w := NewSparseishVector(numBlocks*blockSize, func() Sparse256Array { return new(SplitBinaryArray) })
+		w.blocks[2] = new(OpenAddrArray)
+		w.Put(1, 1)
+		w.Put(2*blockSize+2, 2)
+		w.Put(4*blockSize+4, 4)
+		var buf bytes.Buffer
+		if _, err := w.WriteTo(&buf); err != nil {
+			t.Fatalf("%s: WriteTo error: %v", at.name, err)
+		}
+		if _, err := v.ReadFrom(&buf); err != nil {
+			t.Fatalf("%s: ReadFrom error: %v", at.name, err)
+		}
+		checkLive("ReadFrom", v, s, cp, f, m)
+
+		for _, v := range []*SparseishVector{v, s, cp, f, m} {
+			v.Clear()
+			v.Sweep()
+		}
+		if c.LiveBlocks() != 0 {
+			t.Errorf("%s: LiveBlocks %d after clearing every vector != expected 0", at.name, c.LiveBlocks())
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package vectest
+
+import (
+	"testing"
+
+	"github.com/akmistry/go-util/bitmap"
+)
+
+// ClockArray is a BitmapArray holding at most Limit elements. When a new
+// element is Put into a full array, another element is evicted using the
+// clock (second chance) algorithm: each element has a reference bit, set by
+// Get and Put, and the clock hand sweeps over the present elements in index
+// order, clearing reference bits until it finds an element without one.
+type ClockArray struct {
+	BitmapArray
+	ref  bitmap.Bitmap256
+	hand uint8
+	// Maximum number of elements. Zero means unbounded.
+	Limit int
+}
+
+func (a *ClockArray) Clear() {
+	a.BitmapArray.Clear()
+	a.ref = bitmap.Bitmap256{}
+	a.hand = 0
+}
+
+// next returns the first element at or after i, wrapping around to the start.
+// The array must not be empty.
+func (a *ClockArray) next(i uint8) uint8 {
+	if a.bm.Get(i) {
+		return i
+	} else if j, ok := BitmapNextSet(&a.bm, i); ok {
+		return j
+	} else if a.bm.Get(0) {
+		return 0
+	}
+	j, _ := BitmapNextSet(&a.bm, 0)
+	return j
+}
+
+// evict removes an element chosen by the clock, and returns its index.
+func (a *ClockArray) evict() uint8 {
+	for {
+		i := a.next(a.hand)
+		a.hand = i + 1
+		if !a.ref.Get(i) {
+			a.BitmapArray.Put(i, nil)
+			return i
+		}
+		a.ref.Clear(i)
+	}
+}
+
+// PutEvict is Put, but also returns the index of the element evicted to make
+// room, if any.
+func (a *ClockArray) PutEvict(i uint8, v interface{}) (evicted uint8, ok bool) {
+	if v == nil {
+		a.BitmapArray.Put(i, nil)
+		a.ref.Clear(i)
+		return 0, false
+	}
+	if a.Limit > 0 && !a.bm.Get(i) && a.Len() >= a.Limit {
+		evicted, ok = a.evict(), true
+	}
+	a.BitmapArray.Put(i, v)
+	a.ref.Set(i)
+	return evicted, ok
+}
+
+func (a *ClockArray) Put(i uint8, v interface{}) {
+	a.PutEvict(i, v)
+}
+
+func (a *ClockArray) Get(i uint8) interface{} {
+	v := a.BitmapArray.Get(i)
+	if v != nil {
+		a.ref.Set(i)
+	}
+	return v
+}
+
+func (a *ClockArray) Kind() string {
+	return "ClockArray"
+}
+
+func TestClockArray(t *testing.T) {
+	a := &ClockArray{Limit: 4}
+	for _, i := range []uint8{10, 20, 30, 40} {
+		if _, ok := a.PutEvict(i, int(i)); ok {
+			t.Errorf("Put(%d) evicted below the limit", i)
+		}
+	}
+
+	// Every element is referenced, so the first sweep clears all the
+	// reference bits and comes back round to 10.
+	if e, ok := a.PutEvict(50, 50); e != 10 || !ok {
+		t.Errorf("First eviction (%d, %v) != expected (10, true)", e, ok)
+	}
+	// The hand is after 10. 20, 30 and 40 were cleared by the sweep, but 30
+	// gets a second chance.
+	a.Get(30)
+	if e, ok := a.PutEvict(60, 60); e != 20 || !ok {
+		t.Errorf("Second eviction (%d, %v) != expected (20, true)", e, ok)
+	}
+	if e, ok := a.PutEvict(70, 70); e != 40 || !ok {
+		t.Errorf("Third eviction (%d, %v) != expected (40, true)", e, ok)
+	}
+	// Overwriting a present element doesn't evict.
+	if _, ok := a.PutEvict(30, 31); ok {
+		t.Errorf("Overwrite evicted an element")
+	}
+	// 50, 60, 70 and 30 have all been referenced since the last sweep, so the
+	// hand goes all the way round, wrapping past 70, and back to 50.
+	if e, ok := a.PutEvict(5, 5); e != 50 || !ok {
+		t.Errorf("Fourth eviction (%d, %v) != expected (50, true)", e, ok)
+	}
+
+	expected := map[uint8]interface{}{5: 5, 30: 31, 60: 60, 70: 70}
+	if a.Len() != len(expected) {
+		t.Errorf("Len %d != expected %d", a.Len(), len(expected))
+	}
+	for i, v := range expected {
+		if a.BitmapArray.Get(i) != v {
+			t.Errorf("Get(%d) %v != expected %v", i, a.BitmapArray.Get(i), v)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package vectest
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// ColdBlock wraps a block which can be compressed into its serialized form
+// (as written by WriteTo) to save memory while it isn't being used. It is
+// decompressed on the next access. Values must be gob-encodable, as for
+// WriteTo.
+//
+// The owner calls Tick periodically, and a block that hasn't been accessed
+// since the previous Tick is compressed.
+type ColdBlock struct {
+	alloc func() Sparse256Array
+	// Exactly one of block and data is non-nil.
+	block    Sparse256Array
+	data     []byte
+	accessed bool
+	// Kind of the compressed block.
+	kind string
+}
+
+func NewColdBlock(allocArray func() Sparse256Array) *ColdBlock {
+	return &ColdBlock{alloc: allocArray, block: allocArray()}
+}
+
+// IsCold returns true if the block is currently compressed.
+func (c *ColdBlock) IsCold() bool {
+	return c.data != nil
+}
+
+// Compress serializes the block and drops the uncompressed form.
+func (c *ColdBlock) Compress() {
+	if c.data != nil {
+		return
+	}
+	var buf bytes.Buffer
+	if err := newBlockEncoder(&buf).encode(c.block); err != nil {
+		panic(fmt.Errorf("vectest: compressing block: %w", err))
+	}
+	c.data = buf.Bytes()
+	c.kind = c.block.Kind()
+	c.block = nil
+}
+
+// Tick compresses the block if it hasn't been accessed since the last Tick.
+func (c *ColdBlock) Tick() {
+	if !c.accessed {
+		c.Compress()
+	}
+	c.accessed = false
+}
+
+// get returns the uncompressed block, decompressing it if necessary.
+func (c *ColdBlock) get() Sparse256Array {
+	c.accessed = true
+	if c.data == nil {
+		return c.block
+	}
+	b, err := newBlockDecoder(bytes.NewReader(c.data)).decode(nil, c.alloc)
+	if err != nil {
+		// The data was written by Compress, so this is a bug.
+		panic(fmt.Errorf("vectest: decompressing block: %w", err))
+	}
+	c.block, c.data = b, nil
+	return b
+}
+
+func (c *ColdBlock) Clear() {
+	c.block, c.data = c.alloc(), nil
+	c.accessed = true
+}
+
+func (c *ColdBlock) Put(i uint8, v interface{}) {
+	c.get().Put(i, v)
+}
+
+func (c *ColdBlock) Get(i uint8) interface{} {
+	return c.get().Get(i)
+}
+
+func (c *ColdBlock) Len() int {
+	return c.get().Len()
+}
+
+// Kind returns the kind of the wrapped block, without decompressing it.
+func (c *ColdBlock) Kind() string {
+	if c.block != nil {
+		return c.block.Kind()
+	}
+	return c.kind
+}
+
+func (c *ColdBlock) Range(f func(i uint8, v interface{}) bool) {
+	c.get().Range(f)
+}
+
+func TestColdBlock(t *testing.T) {
+	rng := rand.New(rand.NewSource(*dataSeed))
+	for _, at := range arrayTypes {
+		c := NewColdBlock(at.alloc)
+		ref := at.alloc()
+		for n := 0; n < 5000; n++ {
+			i := uint8(rng.Intn(256))
+			var v interface{}
+			if rng.Intn(4) != 0 {
+				v = n
+			}
+			c.Put(i, v)
+			ref.Put(i, v)
+			if n%100 == 0 {
+				// Two ticks without access in between, so the block is always
+				// compressed.
+				c.Tick()
+				c.Tick()
+				if !c.IsCold() {
+					t.Fatalf("%s: Block not compressed after idle Tick", at.name)
+				}
+				checkArraysEqual(t, at.name, ref, c)
+				if c.IsCold() {
+					t.Fatalf("%s: Block still compressed after access", at.name)
+				}
+				c.Tick()
+				if c.IsCold() {
+					t.Fatalf("%s: Recently accessed block compressed", at.name)
+				}
+			}
+		}
+		checkArraysEqual(t, at.name, ref, c)
+
+		c.Compress()
+		if c.Len() != ref.Len() {
+			t.Errorf("%s: Len %d != expected %d", at.name, c.Len(), ref.Len())
+		}
+		c.Compress()
+		c.Clear()
+		if c.IsCold() || c.Len() != 0 {
+			t.Errorf("%s: Cleared block (cold %v, len %d) != expected (false, 0)", at.name, c.IsCold(), c.Len())
+		}
+	}
+}
+
+func BenchmarkColdBlockGet(b *testing.B) {
+	rng := rand.New(rand.NewSource(*dataSeed))
+	for _, fill := range []int{16, 128, 256} {
+		keys := rng.Perm(256)[:fill]
+		c := NewColdBlock(func() Sparse256Array { return &BitmapArray{} })
+		for _, k := range keys {
+			c.Put(uint8(k), k)
+		}
+		c.Compress()
+		data := c.data
+		c.get()
+
+		b.Run(fmt.Sprintf("%d/Warm", fill), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				c.Get(uint8(i))
+			}
+		})
+		b.Run(fmt.Sprintf("%d/Cold", fill), func(b *testing.B) {
+			b.ReportMetric(float64(len(data)), "bytes")
+			for i := 0; i < b.N; i++ {
+				// Drop back to the compressed form without re-encoding.
+				c.block, c.data = nil, data
+				c.Get(uint8(i))
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package vectest
+
+import (
+	"testing"
+
+	"github.com/akmistry/go-util/bitmap"
+)
+
+// Cursor is a pull-based iterator over the present elements of a
+// SparseishVector, in index order.
+//
+// The set of present indices in a block is read when the cursor reaches the
+// block. Elements deleted after that are skipped, but elements added to a block
+// the cursor has reached are not seen.
+type Cursor struct {
+	v *SparseishVector
+	// Current block, and its present indices.
+	bi int
+	bm bitmap.Bitmap256
+	// Next position to look at in the current block, or blockSize if done.
+	pos int
+}
+
+// Cursor returns a Cursor positioned before the first element.
+func (v *SparseishVector) Cursor() *Cursor {
+	return &Cursor{v: v, bi: -1, pos: blockSize}
+}
+
+// Next returns the next present element, or ok false if there are no more.
+func (c *Cursor) Next() (i int, val interface{}, ok bool) {
+	for c.bi < len(c.v.blocks) {
+		if c.pos < blockSize {
+			j, found := uint8(c.pos), c.bm.Get(uint8(c.pos))
+			if !found {
+				j, found = BitmapNextSet(&c.bm, uint8(c.pos))
+			}
+			if found {
+				c.pos = int(j) + 1
+				if val := c.v.blocks[c.bi].Get(j); val != nil {
+					return c.bi<<blockBits + int(j), val, true
+				}
+				continue
+			}
+		}
+		c.bi++
+		c.pos = 0
+		if c.bi < len(c.v.blocks) {
+			c.bm = blockBitmap(c.v.blocks[c.bi])
+		}
+	}
+	return 0, nil, false
+}
+
+func TestCursor(t *testing.T) {
+	const length = 10 * blockSize
+	for _, at := range arrayTypes {
+		v := newLazySparseishVector(length, at.alloc)
+		for _, k := range generateTestData(*dataSeed, 500, length) {
+			// Leave some blocks unallocated.
+			if k>>blockBits%3 != 1 {
+				v.Put(k, k)
+			}
+		}
+		// The first and last possible indices.
+		v.Put(0, "first")
+		v.Put(length-1, "last")
+
+		var indices []int
+		var values []interface{}
+		v.Range(func(i int, val interface{}) bool {
+			indices = append(indices, i)
+			values = append(values, val)
+			return true
+		})
+
+		c := v.Cursor()
+		n := 0
+		for {
+			i, val, ok := c.Next()
+			if !ok {
+				break
+			}
+			if n >= len(indices) {
+				t.Fatalf("%s: Cursor yielded more than %d elements", at.name, len(indices))
+			} else if i != indices[n] || val != values[n] {
+				t.Errorf("%s: Element %d (%d, %v) != expected (%d, %v)", at.name, n, i, val, indices[n], values[n])
+			}
+			n++
+		}
+		if n != len(indices) {
+			t.Errorf("%s: Cursor yielded %d elements != expected %d", at.name, n, len(indices))
+		}
+		if _, _, ok := c.Next(); ok {
+			t.Errorf("%s: Next after exhaustion returned an element", at.name)
+		}
+
+		// Elements deleted ahead of the cursor are skipped.
+		c = v.Cursor()
+		c.Next()
+		v.Put(indices[1], nil)
+		if i, _, _ := c.Next(); i != indices[2] {
+			t.Errorf("%s: Next after deleting %d returned %d != expected %d", at.name, indices[1], i, indices[2])
+		}
+	}
+}
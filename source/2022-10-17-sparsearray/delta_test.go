@@ -0,0 +1,336 @@
+package vectest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/akmistry/go-util/bitmap"
+)
+
+// Delta serialization
+//
+// A delta is encoded as the new vector length as a uvarint, followed by a
+// record for each block that differs from the base, and a terminating 0
+// uvarint. A record is the block index plus one as a uvarint, the 32-byte
+// bitmap of deleted elements, and the 32-byte bitmap of added or changed
+// elements followed by their values gob-encoded as a []interface{}. As with
+// WriteTo, the gob stream is shared by all records.
+
+// valuesEqual compares a and b with ==, falling back to reflect.DeepEqual for
+// values that aren't comparable, rather than panicking. Comparability is
+// checked on the value rather than its type, since a comparable struct type
+// can have an interface field holding a slice. If a is comparable, so is any
+// b of the same type that == would compare it to.
+func valuesEqual(a, b interface{}) bool {
+	if a == nil || b == nil || !reflect.ValueOf(a).Comparable() {
+		return reflect.DeepEqual(a, b)
+	}
+	return a == b
+}
+
+// SerializeDelta writes the changes needed to turn base into v, comparing the
+// presence bitmap and values of each block. Values are compared with
+// valuesEqual.
+func (v *SparseishVector) SerializeDelta(base *SparseishVector, w io.Writer) (int64, error) {
+	return v.SerializeDeltaFunc(base, w, nil)
+}
+
+// SerializeDeltaFunc is SerializeDelta, but compares values present in both
+// vectors with eq, or with valuesEqual if eq is nil. Values for which eq
+// returns true aren't written.
+func (v *SparseishVector) SerializeDeltaFunc(base *SparseishVector, w io.Writer, eq func(a, b interface{}) bool) (int64, error) {
+	if eq == nil {
+		eq = valuesEqual
+	}
+	cw := &countingWriter{w: w}
+	enc := newBlockEncoder(cw)
+	var buf [binary.MaxVarintLen64]byte
+	writeUvarint := func(x uint64) error {
+		_, err := cw.Write(buf[:binary.PutUvarint(buf[:], x)])
+		return err
+	}
+
+	if err := writeUvarint(uint64(v.len)); err != nil {
+		return cw.n, err
+	}
+	for bi, b := range v.blocks {
+		var baseBlock Sparse256Array
+		if bi < len(base.blocks) {
+			baseBlock = base.blocks[bi]
+		}
+		baseBm, bm := blockBitmap(baseBlock), blockBitmap(b)
+		set, cleared := BitmapDelta(baseBm, bm)
+		enc.values = enc.values[:0]
+		bitmapForEach(&bm, func(i uint8) bool {
+			val := b.Get(i)
+			if set.Get(i) {
+				enc.values = append(enc.values, val)
+			} else if !eq(baseBlock.Get(i), val) {
+				set.Set(i)
+				enc.values = append(enc.values, val)
+			}
+			return true
+		})
+		if len(enc.values) == 0 && cleared == (bitmap.Bitmap256{}) {
+			continue
+		}
+
+		if err := writeUvarint(uint64(bi + 1)); err != nil {
+			return cw.n, err
+		}
+		if _, err := cw.Write(BitmapBytes(&cleared)); err != nil {
+			return cw.n, err
+		}
+		if _, err := cw.Write(BitmapBytes(&set)); err != nil {
+			return cw.n, err
+		}
+		if err := enc.enc.Encode(enc.values); err != nil {
+			return cw.n, err
+		}
+	}
+	return cw.n, writeUvarint(0)
+}
+
+// ApplyDelta returns a copy of base, using base's allocator, with a delta
+// written by SerializeDelta applied.
+func ApplyDelta(base *SparseishVector, r io.Reader) (*SparseishVector, error) {
+	v := base.MapCopy(func(_ int, val interface{}) interface{} {
+		return val
+	})
+	if err := v.ApplyDeltaStream(r); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// ApplyDeltaStream applies a delta written by SerializeDelta to v in place,
+// reading it from r as it goes, so no second vector is allocated. v must be
+// the base the delta was computed against. If an error is returned, v may have
+// been partially modified. As with ReadFrom, nothing past the delta is read
+// from r if it is an io.ByteReader.
+func (v *SparseishVector) ApplyDeltaStream(r io.Reader) error {
+	return v.applyDelta(newBlockDecoder(r))
+}
+
+func (v *SparseishVector) applyDelta(d *blockDecoder) error {
+	length, err := readLength(d.r)
+	if err != nil {
+		return err
+	}
+	v.resize(length)
+
+	for {
+		bi, err := binary.ReadUvarint(d.r)
+		if err != nil {
+			return fmt.Errorf("vectest: reading delta block index: %w", unexpectedEOF(err))
+		} else if bi == 0 {
+			return nil
+		} else if bi > uint64(len(v.blocks)) {
+			return errCorruptBlock
+		}
+		if err := v.applyBlockDelta(d, int(bi-1)); err != nil {
+			return fmt.Errorf("vectest: reading delta for block %d: %w", bi-1, unexpectedEOF(err))
+		}
+	}
+}
+
+func (v *SparseishVector) applyBlockDelta(d *blockDecoder, bi int) error {
+	var buf [64]byte
+	if _, err := io.ReadFull(d.r, buf[:]); err != nil {
+		return err
+	}
+	var cleared, set bitmap.Bitmap256
+	for i := range cleared {
+		cleared[i] = binary.LittleEndian.Uint64(buf[i*8:])
+		set[i] = binary.LittleEndian.Uint64(buf[32+i*8:])
+	}
+	d.values = d.values[:0]
+	if err := d.dec.Decode(&d.values); err != nil {
+		return err
+	}
+	if len(d.values) != set.Count() {
+		return errCorruptBlock
+	}
+
+	base := bi << blockBits
+	bitmapForEach(&cleared, func(i uint8) bool {
+		v.Put(base+int(i), nil)
+		return true
+	})
+	n := 0
+	bitmapForEach(&set, func(i uint8) bool {
+		v.Put(base+int(i), d.values[n])
+		n++
+		return true
+	})
+	return nil
+}
+
+func TestSerializeDelta(t *testing.T) {
+	const length = 40 * blockSize
+	testData := generateTestData(*dataSeed, 4000, length)
+	for _, at := range arrayTypes {
+		base := NewSparseishVector(length, at.alloc)
+		for _, k := range testData {
+			base.Put(k, k)
+		}
+		baseChecksum := base.Checksum()
+
+		// A modified copy with a few adds, deletes and changed values, and a
+		// different length.
+		mod := base.MapCopy(func(_ int, val interface{}) interface{} {
+			return val
+		})
+		mod.Grow(blockSize + 3)
+		mod.Put(length+blockSize+2, "new block")
+		mod.Put(testData[0], nil)
+		mod.Put(testData[1], []int{1})
+		for i := 5 * blockSize; i < 5*blockSize+10; i++ {
+			mod.Put(i, i*2)
+		}
+
+		var full, delta bytes.Buffer
+		if _, err := mod.WriteTo(&full); err != nil {
+			t.Fatalf("%s: WriteTo error: %v", at.name, err)
+		}
+		n, err := mod.SerializeDelta(base, &delta)
+		if err != nil {
+			t.Fatalf("%s: SerializeDelta error: %v", at.name, err)
+		} else if n != int64(delta.Len()) {
+			t.Errorf("%s: SerializeDelta returned %d != written %d", at.name, n, delta.Len())
+		}
+		if delta.Len()*4 > full.Len() {
+			t.Errorf("%s: Delta size %d not much smaller than full size %d", at.name, delta.Len(), full.Len())
+		}
+		encoded := append([]byte(nil), delta.Bytes()...)
+
+		r, err := ApplyDelta(base, bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatalf("%s: ApplyDelta error: %v", at.name, err)
+		}
+		if r.Len() != mod.Len() || r.Checksum() != mod.Checksum() {
+			t.Errorf("%s: ApplyDelta (len %d, checksum %x) != expected (len %d, checksum %x)",
+				at.name, r.Len(), r.Checksum(), mod.Len(), mod.Checksum())
+		}
+		if base.Checksum() != baseChecksum {
+			t.Errorf("%s: ApplyDelta modified the base vector", at.name)
+		}
+
+		// A delta against itself is empty.
+		delta.Reset()
+		if _, err := base.SerializeDelta(base, &delta); err != nil {
+			t.Errorf("%s: SerializeDelta error: %v", at.name, err)
+		} else if delta.Len() != 3 {
+			t.Errorf("%s: Empty delta size %d != expected 3", at.name, delta.Len())
+		}
+
+		for _, l := range []int{0, 1, 10, len(encoded) / 2, len(encoded) - 1} {
+			if _, err := ApplyDelta(base, bytes.NewReader(encoded[:l])); err == nil {
+				t.Errorf("%s: ApplyDelta truncated to %d bytes succeeded", at.name, l)
+			}
+		}
+		// A length of 1<<63+5, which overflows an int.
+		corrupt := []byte{0x85, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01, 0}
+		if _, err := ApplyDelta(base, bytes.NewReader(corrupt)); !errors.Is(err, errCorruptBlock) {
+			t.Errorf("%s: ApplyDelta with corrupt length error %v, expected %v", at.name, err, errCorruptBlock)
+		}
+	}
+}
+
+func TestSerializeDeltaFunc(t *testing.T) {
+	const length = 4 * blockSize
+	for _, at := range arrayTypes {
+		base := NewSparseishVector(length, at.alloc)
+		mod := NewSparseishVector(length, at.alloc)
+		for i := 0; i < 20; i++ {
+			base.Put(i, float64(i))
+			mod.Put(i, float64(i)+0.001)
+		}
+		// registeredHolder is a comparable type, but these values aren't,
+		// since V holds a slice.
+		base.Put(blockSize, registeredHolder{[]int{1}})
+		mod.Put(blockSize, registeredHolder{[]int{1}})
+		base.Put(blockSize+1, registeredHolder{[]int{1}})
+		mod.Put(blockSize+1, registeredHolder{[]int{2}})
+		mod.Put(2*blockSize, "added")
+
+		// Values within a tolerance are equal, so only the added element
+		// and the changed holder are in the delta.
+		approx := func(a, b interface{}) bool {
+			if fa, ok := a.(float64); ok {
+				fb, ok := b.(float64)
+				return ok && math.Abs(fa-fb) < 0.01
+			}
+			return valuesEqual(a, b)
+		}
+		var delta bytes.Buffer
+		if _, err := mod.SerializeDeltaFunc(base, &delta, approx); err != nil {
+			t.Fatalf("%s: SerializeDeltaFunc error: %v", at.name, err)
+		}
+		r, err := ApplyDelta(base, &delta)
+		if err != nil {
+			t.Fatalf("%s: ApplyDelta error: %v", at.name, err)
+		}
+		if r.Get(3) != 3.0 || r.Get(2*blockSize) != "added" {
+			t.Errorf("%s: ApplyDelta Get (%v, %v) != expected (3, added)", at.name, r.Get(3), r.Get(2*blockSize))
+		}
+		if h, ok := r.Get(blockSize + 1).(registeredHolder); !ok || !reflect.DeepEqual(h.V, []int{2}) {
+			t.Errorf("%s: ApplyDelta Get(%d) %v != expected {[2]}", at.name, blockSize+1, r.Get(blockSize+1))
+		}
+
+		// With the default comparison, every changed float is written.
+		delta.Reset()
+		if _, err := mod.SerializeDelta(base, &delta); err != nil {
+			t.Fatalf("%s: SerializeDelta error: %v", at.name, err)
+		}
+		if r, err := ApplyDelta(base, &delta); err != nil {
+			t.Fatalf("%s: ApplyDelta error: %v", at.name, err)
+		} else if !r.Equal(mod) {
+			t.Errorf("%s: ApplyDelta of SerializeDelta != modified vector", at.name)
+		}
+	}
+}
+
+func TestApplyDeltaStream(t *testing.T) {
+	const length = 20 * blockSize
+	testData := generateTestData(*dataSeed, 2000, length)
+	for _, at := range arrayTypes {
+		base := newLazySparseishVector(length, at.alloc)
+		for _, k := range testData {
+			base.Put(k, k)
+		}
+		mod := base.Copy()
+		// Shrink, removing the last block, and add, delete and change
+		// elements, including in a previously unallocated block.
+		mod.resize(length - blockSize)
+		mod.Put(testData[0], nil)
+		mod.Put(testData[1], "changed")
+		mod.Put(7, "added")
+		for i := 3 * blockSize; i < 4*blockSize; i++ {
+			mod.Put(i, nil)
+		}
+
+		var delta bytes.Buffer
+		if _, err := mod.SerializeDelta(base, &delta); err != nil {
+			t.Fatalf("%s: SerializeDelta error: %v", at.name, err)
+		}
+		// Data following the delta in the stream must be left unread.
+		delta.WriteString("trailer")
+		if err := base.ApplyDeltaStream(&delta); err != nil {
+			t.Fatalf("%s: ApplyDeltaStream error: %v", at.name, err)
+		}
+		if !base.Equal(mod) {
+			t.Errorf("%s: Vector after ApplyDeltaStream (len %d, count %d) != expected (len %d, count %d)",
+				at.name, base.Len(), base.Count(), mod.Len(), mod.Count())
+		}
+		if delta.String() != "trailer" {
+			t.Errorf("%s: Data left after ApplyDeltaStream %q != expected %q", at.name, delta.String(), "trailer")
+		}
+	}
+}
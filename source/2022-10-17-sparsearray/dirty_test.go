@@ -0,0 +1,94 @@
+package vectest
+
+import (
+	"reflect"
+	"testing"
+)
+
+// DirtySparseishVector is a SparseishVector which records which blocks have
+// been written since the last MarkClean, so incremental persistence can
+// serialize only those blocks.
+//
+// Blocks are marked dirty by Put and Clear. Other methods which modify the
+// vector bypass the tracking.
+type DirtySparseishVector struct {
+	*SparseishVector
+	dirty []bool
+}
+
+func NewDirtySparseishVector(length int, allocArray func() Sparse256Array) *DirtySparseishVector {
+	v := NewSparseishVector(length, allocArray)
+	return &DirtySparseishVector{SparseishVector: v, dirty: make([]bool, len(v.blocks))}
+}
+
+func (v *DirtySparseishVector) markDirty(bi int) {
+	if bi >= len(v.dirty) {
+		// The vector has been grown.
+		v.dirty = append(v.dirty, make([]bool, len(v.blocks)-len(v.dirty))...)
+	}
+	v.dirty[bi] = true
+}
+
+func (v *DirtySparseishVector) Put(i int, val interface{}) {
+	v.SparseishVector.Put(i, val)
+	v.markDirty(i >> blockBits)
+}
+
+// Clear is SparseishVector.Clear, marking every block that had elements dirty.
+func (v *DirtySparseishVector) Clear() {
+	for bi, b := range v.blocks {
+		if !blockIsEmpty(b) {
+			v.markDirty(bi)
+		}
+	}
+	v.SparseishVector.Clear()
+}
+
+// DirtyBlocks returns the indices of the blocks written since the last
+// MarkClean, in ascending order.
+func (v *DirtySparseishVector) DirtyBlocks() []int {
+	var blocks []int
+	for bi, d := range v.dirty {
+		if d {
+			blocks = append(blocks, bi)
+		}
+	}
+	return blocks
+}
+
+// MarkClean marks every block clean, typically after they have been flushed.
+func (v *DirtySparseishVector) MarkClean() {
+	for bi := range v.dirty {
+		v.dirty[bi] = false
+	}
+}
+
+func TestDirtySparseishVector(t *testing.T) {
+	for _, at := range arrayTypes {
+		v := NewDirtySparseishVector(10*blockSize, at.alloc)
+		if d := v.DirtyBlocks(); len(d) != 0 {
+			t.Errorf("%s: New vector has dirty blocks %v", at.name, d)
+		}
+
+		v.Put(7*blockSize+3, 1)
+		v.Put(2*blockSize, 2)
+		v.Put(2*blockSize+255, 3)
+		// Deletes are writes too.
+		v.Put(5*blockSize+1, nil)
+		if d := v.DirtyBlocks(); !reflect.DeepEqual(d, []int{2, 5, 7}) {
+			t.Errorf("%s: DirtyBlocks %v != expected [2 5 7]", at.name, d)
+		}
+
+		v.MarkClean()
+		if d := v.DirtyBlocks(); len(d) != 0 {
+			t.Errorf("%s: Dirty blocks %v after MarkClean", at.name, d)
+		}
+
+		v.Grow(blockSize)
+		v.Put(10*blockSize+1, 4)
+		v.Clear()
+		if d := v.DirtyBlocks(); !reflect.DeepEqual(d, []int{2, 7, 10}) {
+			t.Errorf("%s: DirtyBlocks after Grow and Clear %v != expected [2 7 10]", at.name, d)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package vectest
+
+import (
+	"iter"
+	"math/rand"
+	"sort"
+	"testing"
+	"unsafe"
+)
+
+// FrozenArray is a read-only block, with the SplitBinaryArray layout of sorted
+// indexes and values, but with exactly sized slices. On amd64 it takes 48+17n
+// bytes, against 56+16n for a BitmapArray without append slack, so it is the
+// smaller of the two for blocks of up to 7 elements, and usually smaller than a
+// live BitmapArray for much fuller blocks. Put and Clear panic.
+type FrozenArray struct {
+	indexes []uint8
+	values  []interface{}
+}
+
+// Freeze returns a read-only copy of b, with exactly sized slices.
+func Freeze(b Sparse256Array) *FrozenArray {
+	n := b.Len()
+	a := &FrozenArray{indexes: make([]uint8, 0, n), values: make([]interface{}, 0, n)}
+	b.Range(func(i uint8, v interface{}) bool {
+		a.indexes = append(a.indexes, i)
+		a.values = append(a.values, v)
+		return true
+	})
+	return a
+}
+
+// Freeze converts every allocated block to a FrozenArray, and frees the empty
+// ones. After this, Put, Clear and other methods which add or delete elements
+// panic, whether or not the element's block is allocated.
+func (v *SparseishVector) Freeze() {
+	v.frozen = true
+	for bi, b := range v.blocks {
+		if blockIsEmpty(b) {
+			v.freeBlock(bi)
+		} else {
+			v.adoptBlock(bi, Freeze(b))
+		}
+	}
+}
+
+func (a *FrozenArray) Clear() {
+	panic("vectest: Clear on FrozenArray")
+}
+
+func (a *FrozenArray) Put(i uint8, v interface{}) {
+	panic("vectest: Put on FrozenArray")
+}
+
+func (a *FrozenArray) Get(i uint8) interface{} {
+	index := sort.Search(len(a.indexes), func(n int) bool {
+		return a.indexes[n] >= i
+	})
+	if index < len(a.indexes) && a.indexes[index] == i {
+		return a.values[index]
+	}
+	return nil
+}
+
+func (a *FrozenArray) Len() int {
+	return len(a.indexes)
+}
+
+func (a *FrozenArray) Kind() string {
+	return "FrozenArray"
+}
+
+func (a *FrozenArray) Range(f func(i uint8, v interface{}) bool) {
+	for n, i := range a.indexes {
+		if !f(i, a.values[n]) {
+			return
+		}
+	}
+}
+
+// All returns an iterator over the elements, for use with range.
+func (a *FrozenArray) All() iter.Seq2[uint8, interface{}] {
+	return a.Range
+}
+
+func TestFreeze(t *testing.T) {
+	rng := rand.New(rand.NewSource(*dataSeed))
+	for _, fill := range []int{1, 7, 40, 100} {
+		live := &BitmapArray{}
+		for _, k := range rng.Perm(256)[:fill] {
+			live.Put(uint8(k), k)
+		}
+		frozen := Freeze(live)
+		checkArraysEqual(t, "FrozenArray", live, frozen)
+		if frozen.Len() != fill {
+			t.Errorf("Fill %d: Len %d != expected %d", fill, frozen.Len(), fill)
+		}
+
+		liveSize := int(unsafe.Sizeof(*live)) + cap(live.values)*int(unsafe.Sizeof(live.values[0]))
+		frozenSize := int(unsafe.Sizeof(*frozen)) + cap(frozen.indexes) +
+			cap(frozen.values)*int(unsafe.Sizeof(frozen.values[0]))
+		t.Logf("Fill %d: live BitmapArray %d bytes, FrozenArray %d bytes", fill, liveSize, frozenSize)
+		if frozenSize >= liveSize {
+			t.Errorf("Fill %d: FrozenArray size %d not less than BitmapArray %d", fill, frozenSize, liveSize)
+		}
+	}
+
+	v := NewSparseishVector(4*blockSize, arrayTypes[0].alloc)
+	v.Put(3, 3)
+	v.Put(3*blockSize+9, 9)
+	v.Freeze()
+	if v.blocks[1] != nil || v.blocks[0].Kind() != "FrozenArray" {
+		t.Errorf("Frozen vector blocks (%v, %s) != expected (nil, FrozenArray)", v.blocks[1], v.blocks[0].Kind())
+	}
+	if v.Get(3) != 3 || v.Get(3*blockSize+9) != 9 || v.Count() != 2 {
+		t.Errorf("Frozen vector (Get %v, %v, Count %d) != expected (3, 9, 2)", v.Get(3), v.Get(3*blockSize+9), v.Count())
+	}
+	for _, tc := range []struct {
+		name string
+		f    func()
+	}{
+		{"Put in frozen block", func() { v.Put(3, 4) }},
+		{"Put in freed block", func() { v.Put(blockSize+20, 2) }},
+		{"Put in unallocated block", func() { v.Put(2*blockSize, 2) }},
+		{"Delete in unallocated block", func() { v.Put(2*blockSize, nil) }},
+		{"Clear", v.Clear},
+		{"GetOrCompute", func() { v.GetOrCompute(2*blockSize, func() interface{} { return 1 }) }},
+		{"FillRange", func() { v.FillRange(2*blockSize, 2*blockSize+5, 1) }},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s on frozen vector didn't panic", tc.name)
+				}
+			}()
+			tc.f()
+		}()
+	}
+	if v.Count() != 2 {
+		t.Errorf("Frozen vector Count %d after failed modifications != expected 2", v.Count())
+	}
+}
@@ -0,0 +1,168 @@
+package vectest
+
+import (
+	"math"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// Integer is the set of key types for GenVector. 8-bit types are left out,
+// since their keys all fit in a single block.
+type Integer interface {
+	~int | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+// GenVector is a sparse vector keyed by any integer type, with unboxed values
+// of type V. A key is split into a block key (all but the low byte) and an
+// offset within the block, as in SparseishVector. Blocks are found through a
+// map rather than a slice, so keys can span the whole of a 64-bit keyspace.
+type GenVector[K Integer, V any] struct {
+	blocks map[K]*PackedBitmapArray[V]
+	len    int
+}
+
+func NewGenVector[K Integer, V any]() *GenVector[K, V] {
+	return &GenVector[K, V]{blocks: make(map[K]*PackedBitmapArray[V])}
+}
+
+func splitKey[K Integer](k K) (block K, offset uint8) {
+	return k >> blockBits, uint8(k)
+}
+
+func (v *GenVector[K, V]) Put(k K, val V) {
+	bk, off := splitKey(k)
+	b := v.blocks[bk]
+	if b == nil {
+		b = &PackedBitmapArray[V]{}
+		v.blocks[bk] = b
+	}
+	n := b.Len()
+	b.Set(off, val)
+	v.len += b.Len() - n
+}
+
+func (v *GenVector[K, V]) Get(k K) (V, bool) {
+	bk, off := splitKey(k)
+	if b := v.blocks[bk]; b != nil {
+		return b.Lookup(off)
+	}
+	var zero V
+	return zero, false
+}
+
+// Delete removes k, freeing its block if it becomes empty.
+func (v *GenVector[K, V]) Delete(k K) {
+	bk, off := splitKey(k)
+	b := v.blocks[bk]
+	if b == nil {
+		return
+	}
+	n := b.Len()
+	b.Delete(off)
+	v.len -= n - b.Len()
+	if b.Len() == 0 {
+		delete(v.blocks, bk)
+	}
+}
+
+// Len returns the number of present elements.
+func (v *GenVector[K, V]) Len() int {
+	return v.len
+}
+
+// Range calls f for each present element in ascending key order, stopping if
+// f returns false. The block keys are sorted on each call.
+func (v *GenVector[K, V]) Range(f func(k K, val V) bool) {
+	keys := make([]K, 0, len(v.blocks))
+	for bk := range v.blocks {
+		keys = append(keys, bk)
+	}
+	slices.Sort(keys)
+	for _, bk := range keys {
+		cont := true
+		v.blocks[bk].RangeT(func(off uint8, val V) bool {
+			cont = f(bk<<blockBits|K(off), val)
+			return cont
+		})
+		if !cont {
+			return
+		}
+	}
+}
+
+func TestGenVector(t *testing.T) {
+	v := NewGenVector[uint64, int32]()
+	ref := make(map[uint64]int32)
+	// Keys at both ends of the keyspace, and pairs in the same block.
+	keys := []uint64{0, 255, 256, math.MaxUint64, math.MaxUint64 - 255, math.MaxUint64 - 256, 1 << 40, 1<<40 + 1}
+	rng := rand.New(rand.NewSource(*dataSeed))
+	for n := 0; n < 1000; n++ {
+		keys = append(keys, rng.Uint64(), rng.Uint64()>>32)
+	}
+	for n, k := range keys {
+		v.Put(k, int32(n))
+		ref[k] = int32(n)
+	}
+	for n, k := range keys {
+		if n%3 == 0 {
+			v.Delete(k)
+			delete(ref, k)
+		}
+	}
+	v.Delete(12345)
+
+	if v.Len() != len(ref) {
+		t.Errorf("Len %d != expected %d", v.Len(), len(ref))
+	}
+	for _, k := range keys {
+		val, ok := v.Get(k)
+		rv, rok := ref[k]
+		if val != rv || ok != rok {
+			t.Errorf("Get(%d) (%d, %v) != expected (%d, %v)", k, val, ok, rv, rok)
+		}
+	}
+
+	// Block routing.
+	for _, pair := range [][2]uint64{{math.MaxUint64, math.MaxUint64 - 255}, {1 << 40, 1<<40 + 1}} {
+		b0, _ := splitKey(pair[0])
+		b1, _ := splitKey(pair[1])
+		if b0 != b1 {
+			t.Errorf("Keys %d and %d in blocks %d and %d, expected the same", pair[0], pair[1], b0, b1)
+		}
+	}
+	if b, off := splitKey(uint64(math.MaxUint64 - 256)); b != 1<<56-2 || off != 255 {
+		t.Errorf("splitKey(MaxUint64-256) (%d, %d) != expected (%d, 255)", b, off, uint64(1<<56-2))
+	}
+
+	last, first, count := uint64(0), true, 0
+	v.Range(func(k uint64, val int32) bool {
+		if !first && k <= last {
+			t.Errorf("Range key %d not after %d", k, last)
+		}
+		if ref[k] != val {
+			t.Errorf("Range value at %d %d != expected %d", k, val, ref[k])
+		}
+		last, first = k, false
+		count++
+		return true
+	})
+	if count != len(ref) {
+		t.Errorf("Range yielded %d elements != expected %d", count, len(ref))
+	}
+
+	// Signed keys, including negative ones.
+	sv := NewGenVector[int32, string]()
+	for _, k := range []int32{-1, -256, -257, 0, math.MinInt32, math.MaxInt32} {
+		sv.Put(k, "x")
+	}
+	var got []int32
+	sv.Range(func(k int32, _ string) bool {
+		got = append(got, k)
+		return true
+	})
+	if expected := []int32{math.MinInt32, -257, -256, -1, 0, math.MaxInt32}; !slices.Equal(got, expected) {
+		t.Errorf("Signed Range keys %v != expected %v", got, expected)
+	}
+}
@@ -1,5 +1,5 @@
 module github.com/akmistry/akmistry.github.io/source/2022-10-17-sparsearray
 
-go 1.19
+go 1.23
 
 require github.com/akmistry/go-util v0.0.0-20221016205648-ee4389ec7fab
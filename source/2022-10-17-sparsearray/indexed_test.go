@@ -0,0 +1,130 @@
+package vectest
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"unsafe"
+)
+
+// ValuePool interns values, handing out a uint32 handle for each distinct
+// value. Values must be comparable, unless Eq is set.
+type ValuePool struct {
+	handles map[interface{}]uint32
+	values  []interface{}
+
+	// If set, values are matched with Eq by a linear search of the pool,
+	// rather than by map lookup. This allows non-comparable values, such as
+	// slices, but makes Intern O(n).
+	Eq func(a, b interface{}) bool
+}
+
+// Intern returns the handle for v, adding v to the pool if necessary.
+func (p *ValuePool) Intern(v interface{}) uint32 {
+	if p.Eq != nil {
+		for h, pv := range p.values {
+			if p.Eq(pv, v) {
+				return uint32(h)
+			}
+		}
+		p.values = append(p.values, v)
+		return uint32(len(p.values) - 1)
+	} else if h, ok := p.handles[v]; ok {
+		return h
+	}
+	if p.handles == nil {
+		p.handles = make(map[interface{}]uint32)
+	}
+	h := uint32(len(p.values))
+	p.handles[v] = h
+	p.values = append(p.values, v)
+	return h
+}
+
+// Value returns the value for handle h.
+func (p *ValuePool) Value(h uint32) interface{} {
+	return p.values[h]
+}
+
+// IndexedBitmapArray is a BitmapArray which stores uint32 handles into a
+// caller-managed value pool, such as a ValuePool, instead of the values
+// themselves. When values are large and repeated, this reduces the per-element
+// cost to 4 bytes.
+type IndexedBitmapArray = PackedBitmapArray[uint32]
+
+func TestIndexedBitmapArray(t *testing.T) {
+	var pool ValuePool
+	var a IndexedBitmapArray
+	ref := make(map[uint8]string)
+	rng := rand.New(rand.NewSource(*dataSeed))
+	for n := 0; n < 5000; n++ {
+		i := uint8(rng.Intn(256))
+		if rng.Intn(3) == 0 {
+			a.Delete(i)
+			delete(ref, i)
+		} else {
+			// Only a few distinct values, so most are shared.
+			v := fmt.Sprintf("value-%d", rng.Intn(10))
+			a.Set(i, pool.Intern(v))
+			ref[i] = v
+		}
+	}
+	if len(pool.values) > 10 {
+		t.Errorf("Pool size %d > expected 10", len(pool.values))
+	}
+	for i := 0; i < 256; i++ {
+		h, ok := a.Lookup(uint8(i))
+		rv, rok := ref[uint8(i)]
+		if ok != rok || (ok && pool.Value(h) != rv) {
+			t.Errorf("Get(%d) (%d, %v) != expected (%q, %v)", i, h, ok, rv, rok)
+		}
+	}
+	count := 0
+	a.RangeT(func(i uint8, h uint32) bool {
+		if pool.Value(h) != ref[i] {
+			t.Errorf("Range value at %d %v != expected %q", i, pool.Value(h), ref[i])
+		}
+		count++
+		return true
+	})
+	if count != len(ref) || a.Len() != len(ref) {
+		t.Errorf("Range count %d, Len %d != expected %d", count, a.Len(), len(ref))
+	}
+}
+
+func BenchmarkIndexedBitmapArray(b *testing.B) {
+	var pool ValuePool
+	values := make([]interface{}, 16)
+	for i := range values {
+		values[i] = fmt.Sprintf("a long, repeated value %d", i)
+		pool.Intern(values[i])
+	}
+
+	rng := rand.New(rand.NewSource(*dataSeed))
+	for _, fill := range []int{16, 128, 256} {
+		keys := rng.Perm(256)[:fill]
+
+		b.Run(fmt.Sprintf("%d/BitmapArray", fill), func(b *testing.B) {
+			var a BitmapArray
+			for i := 0; i < b.N; i++ {
+				a.Clear()
+				for _, k := range keys {
+					a.Put(uint8(k), values[k%len(values)])
+				}
+			}
+			size := int(unsafe.Sizeof(a)) + cap(a.values)*int(unsafe.Sizeof(a.values[0]))
+			b.ReportMetric(float64(size)/float64(fill), "bytes/elem")
+		})
+		b.Run(fmt.Sprintf("%d/IndexedBitmapArray", fill), func(b *testing.B) {
+			var a IndexedBitmapArray
+			for i := 0; i < b.N; i++ {
+				a.Clear()
+				for _, k := range keys {
+					a.Set(uint8(k), pool.Intern(values[k%len(values)]))
+				}
+			}
+			size := int(unsafe.Sizeof(a)) + cap(a.values)*int(unsafe.Sizeof(a.values[0]))
+			b.ReportMetric(float64(size)/float64(fill), "bytes/elem")
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package vectest
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"unsafe"
+)
+
+// Int32BitmapArray is a BitmapArray for int32 values, stored unboxed at 4
+// bytes per element.
+type Int32BitmapArray = PackedBitmapArray[int32]
+
+func TestInt32BitmapArray(t *testing.T) {
+	var a Int32BitmapArray
+	ref := make(map[uint8]int32)
+	rng := rand.New(rand.NewSource(*dataSeed))
+	for n := 0; n < 5000; n++ {
+		i := uint8(rng.Intn(256))
+		if rng.Intn(3) == 0 {
+			a.Delete(i)
+			delete(ref, i)
+		} else {
+			v := rng.Int31() - 1<<30
+			a.Set(i, v)
+			ref[i] = v
+		}
+	}
+	for i := 0; i < 256; i++ {
+		v, ok := a.Lookup(uint8(i))
+		rv, rok := ref[uint8(i)]
+		if v != rv || ok != rok {
+			t.Errorf("Get(%d) (%d, %v) != expected (%d, %v)", i, v, ok, rv, rok)
+		}
+	}
+	count := 0
+	a.RangeT(func(i uint8, v int32) bool {
+		if ref[i] != v {
+			t.Errorf("Range value at %d %d != expected %d", i, v, ref[i])
+		}
+		count++
+		return true
+	})
+	if count != len(ref) || a.Len() != len(ref) {
+		t.Errorf("Range count %d, Len %d != expected %d", count, a.Len(), len(ref))
+	}
+}
+
+func BenchmarkInt32BitmapArray(b *testing.B) {
+	rng := rand.New(rand.NewSource(*dataSeed))
+	for _, fill := range []int{16, 128, 256} {
+		keys := rng.Perm(256)[:fill]
+
+		b.Run(fmt.Sprintf("%d/BitmapArray", fill), func(b *testing.B) {
+			var a BitmapArray
+			for i := 0; i < b.N; i++ {
+				a.Clear()
+				for _, k := range keys {
+					a.Put(uint8(k), testValues[k])
+				}
+			}
+			// Pre-boxed values, so only the interface values are counted, not
+			// the ints they point to.
+			size := int(unsafe.Sizeof(a)) + cap(a.values)*int(unsafe.Sizeof(a.values[0]))
+			b.ReportMetric(float64(size)/float64(fill), "bytes/elem")
+		})
+		b.Run(fmt.Sprintf("%d/Int32BitmapArray", fill), func(b *testing.B) {
+			var a Int32BitmapArray
+			for i := 0; i < b.N; i++ {
+				a.Clear()
+				for _, k := range keys {
+					a.Set(uint8(k), int32(k))
+				}
+			}
+			size := int(unsafe.Sizeof(a)) + cap(a.values)*int(unsafe.Sizeof(a.values[0]))
+			b.ReportMetric(float64(size)/float64(fill), "bytes/elem")
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package vectest
+
+import (
+	"iter"
+	"math/rand"
+	"testing"
+
+	"github.com/akmistry/go-util/bitmap"
+)
+
+// LazyBitmapArray is a BitmapArray where deletes leave a tombstone in the
+// values slice instead of shifting the following values down. A later Put to
+// the same index reuses the slot. Compact reclaims tombstones.
+type LazyBitmapArray struct {
+	// Present elements.
+	bm bitmap.Bitmap256
+	// Elements with a slot in values, including tombstones.
+	slots  bitmap.Bitmap256
+	values []interface{}
+
+	// When the number of tombstones reaches CompactThreshold, DeleteLazy
+	// compacts the array. Zero disables automatic compaction.
+	CompactThreshold int
+}
+
+func (a *LazyBitmapArray) Clear() {
+	a.bm = bitmap.Bitmap256{}
+	a.slots = bitmap.Bitmap256{}
+	a.values = nil
+}
+
+func (a *LazyBitmapArray) Put(i uint8, v interface{}) {
+	if v == nil {
+		a.DeleteLazy(i)
+		return
+	}
+	index := a.slots.CountLess(i)
+	if !a.slots.Get(i) {
+		a.slots.Set(i)
+		a.values = append(a.values, nil)
+		copy(a.values[index+1:], a.values[index:])
+	}
+	a.bm.Set(i)
+	a.values[index] = v
+}
+
+func (a *LazyBitmapArray) Get(i uint8) interface{} {
+	if a.bm.Get(i) {
+		return a.values[a.slots.CountLess(i)]
+	}
+	return nil
+}
+
+func (a *LazyBitmapArray) Len() int {
+	return a.bm.Count()
+}
+
+func (a *LazyBitmapArray) Kind() string {
+	return "LazyBitmapArray"
+}
+
+func (a *LazyBitmapArray) Range(f func(i uint8, v interface{}) bool) {
+	n := 0
+	bitmapForEach(&a.slots, func(i uint8) bool {
+		n++
+		if !a.bm.Get(i) {
+			return true
+		}
+		return f(i, a.values[n-1])
+	})
+}
+
+// All returns an iterator over the elements, for use with range.
+func (a *LazyBitmapArray) All() iter.Seq2[uint8, interface{}] {
+	return a.Range
+}
+
+// DeleteLazy deletes the element at i, leaving its slot as a tombstone.
+func (a *LazyBitmapArray) DeleteLazy(i uint8) {
+	if !a.bm.Get(i) {
+		return
+	}
+	a.bm.Clear(i)
+	// Drop the reference so the value can be collected.
+	a.values[a.slots.CountLess(i)] = nil
+	if a.CompactThreshold > 0 && a.Tombstones() >= a.CompactThreshold {
+		a.Compact()
+	}
+}
+
+// Tombstones returns the number of deleted slots not yet reclaimed.
+func (a *LazyBitmapArray) Tombstones() int {
+	return len(a.values) - a.bm.Count()
+}
+
+// Compact removes all tombstones from the values slice.
+func (a *LazyBitmapArray) Compact() {
+	n, out := 0, 0
+	bitmapForEach(&a.slots, func(i uint8) bool {
+		if a.bm.Get(i) {
+			a.values[out] = a.values[n]
+			out++
+		}
+		n++
+		return true
+	})
+	for j := out; j < len(a.values); j++ {
+		a.values[j] = nil
+	}
+	a.values = a.values[:out]
+	a.slots = a.bm
+}
+
+func TestLazyBitmapArray(t *testing.T) {
+	rng := rand.New(rand.NewSource(*dataSeed))
+	for _, threshold := range []int{0, 1, 8} {
+		a := &LazyBitmapArray{CompactThreshold: threshold}
+		ref := make(map[uint8]interface{})
+		for n := 0; n < 5000; n++ {
+			i := uint8(rng.Intn(256))
+			if rng.Intn(2) == 0 {
+				a.Put(i, n)
+				ref[i] = n
+			} else {
+				a.DeleteLazy(i)
+				delete(ref, i)
+			}
+			if threshold > 0 && a.Tombstones() >= threshold {
+				t.Fatalf("Threshold %d: %d tombstones not compacted", threshold, a.Tombstones())
+			}
+			if n%1000 == 999 {
+				a.Compact()
+				if a.Tombstones() != 0 {
+					t.Errorf("Threshold %d: %d tombstones after Compact", threshold, a.Tombstones())
+				}
+			}
+		}
+		for i := 0; i < 256; i++ {
+			if a.Get(uint8(i)) != ref[uint8(i)] {
+				t.Errorf("Threshold %d: Get(%d) %v != expected %v",
+					threshold, i, a.Get(uint8(i)), ref[uint8(i)])
+			}
+		}
+		count := 0
+		a.Range(func(i uint8, v interface{}) bool {
+			if v != ref[i] {
+				t.Errorf("Threshold %d: Range value at %d %v != expected %v", threshold, i, v, ref[i])
+			}
+			count++
+			return true
+		})
+		if count != len(ref) {
+			t.Errorf("Threshold %d: Range count %d != expected %d", threshold, count, len(ref))
+		}
+	}
+}
+
+func BenchmarkDelete90(b *testing.B) {
+	const fill = 256 * 90 / 100
+	keys := rand.New(rand.NewSource(*dataSeed)).Perm(256)[:fill]
+
+	b.Run("Eager", func(b *testing.B) {
+		var a BitmapArray
+		for _, k := range keys {
+			a.Put(uint8(k), k)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			k := uint8(keys[i%fill])
+			a.Put(k, nil)
+			a.Put(k, i)
+		}
+	})
+	for _, threshold := range []int{0, 16} {
+		name := "Lazy"
+		if threshold > 0 {
+			name = "LazyCompact16"
+		}
+		b.Run(name, func(b *testing.B) {
+			a := &LazyBitmapArray{CompactThreshold: threshold}
+			for _, k := range keys {
+				a.Put(uint8(k), k)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				k := uint8(keys[i%fill])
+				a.DeleteLazy(k)
+				a.Put(k, i)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package vectest
+
+import (
+	"testing"
+)
+
+// LenientPut is Put, but silently drops the write if i is outside [0, Len).
+func (v *SparseishVector) LenientPut(i int, val interface{}) {
+	if i < 0 || i >= v.len {
+		return
+	}
+	v.Put(i, val)
+}
+
+// LenientSparseishVector is a SparseishVector which never panics on an
+// out-of-range index. Put drops writes outside [0, Len), and Get returns nil
+// for them. This is for callers, such as loggers, which would rather lose a
+// write than crash.
+type LenientSparseishVector struct {
+	*SparseishVector
+}
+
+func NewLenientSparseishVector(length int, allocArray func() Sparse256Array) *LenientSparseishVector {
+	return &LenientSparseishVector{NewSparseishVector(length, allocArray)}
+}
+
+func (v *LenientSparseishVector) Put(i int, val interface{}) {
+	v.LenientPut(i, val)
+}
+
+func (v *LenientSparseishVector) Get(i int) interface{} {
+	if i < 0 || i >= v.len {
+		return nil
+	}
+	return v.SparseishVector.Get(i)
+}
+
+func TestLenientSparseishVector(t *testing.T) {
+	// Not a multiple of the block size, so [Len, Cap) is non-empty.
+	const length = 3*blockSize + 10
+	for _, at := range arrayTypes {
+		v := NewLenientSparseishVector(length, at.alloc)
+		for _, i := range []int{-1, -blockSize, length, length + 1, v.Cap(), 1 << 30} {
+			v.Put(i, i)
+			if got := v.Get(i); got != nil {
+				t.Errorf("%s: Get(%d) %v != expected nil", at.name, i, got)
+			}
+		}
+		if c := v.Count(); c != 0 {
+			t.Errorf("%s: Count %d after out-of-range Puts != expected 0", at.name, c)
+		}
+
+		for _, i := range []int{0, blockSize, length - 1} {
+			v.Put(i, i)
+			if got := v.Get(i); got != i {
+				t.Errorf("%s: Get(%d) %v != expected %d", at.name, i, got, i)
+			}
+		}
+		if c := v.Count(); c != 3 {
+			t.Errorf("%s: Count %d != expected 3", at.name, c)
+		}
+
+		// LenientPut on a plain vector also drops the write, even in [Len, Cap)
+		// where Put would succeed.
+		sv := NewSparseishVector(length, at.alloc)
+		sv.LenientPut(length, 1)
+		sv.LenientPut(-1, 1)
+		sv.LenientPut(5, 5)
+		if c := sv.Count(); c != 1 || sv.Get(5) != 5 {
+			t.Errorf("%s: LenientPut (count %d, Get(5) %v) != expected (1, 5)", at.name, c, sv.Get(5))
+		}
+	}
+}
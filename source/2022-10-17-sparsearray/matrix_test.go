@@ -0,0 +1,144 @@
+package vectest
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+var matrixOut = flag.String("matrix", "",
+	"File to write the TestComparisonMatrix CSV table to (test skipped if empty)")
+
+// heapAlloc returns the live heap size after a GC.
+func heapAlloc() uint64 {
+	var ms runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&ms)
+	return ms.HeapAlloc
+}
+
+// EstimatedBytesPerElement measures the heap used per element by blocks of the
+// named array type holding fill elements each, including the boxed values.
+// Unlike the sizeof logging in init, this counts everything the arrays
+// allocate, as a real workload would see.
+func EstimatedBytesPerElement(arrayType string, fill int) float64 {
+	const numBlocks = 1000
+	var alloc func() Sparse256Array
+	for _, at := range arrayTypes {
+		if at.name == arrayType {
+			alloc = at.alloc
+		}
+	}
+	if alloc == nil {
+		panic(fmt.Sprintf("vectest: unknown array type %q", arrayType))
+	} else if fill <= 0 {
+		return 0
+	}
+	// Distinct indices, so each block holds exactly fill elements.
+	keys := rand.New(rand.NewSource(*dataSeed)).Perm(blockSize)[:fill]
+
+	blocks := make([]Sparse256Array, numBlocks)
+	before := heapAlloc()
+	for n := range blocks {
+		b := alloc()
+		for _, k := range keys {
+			// Ints >= 256 are boxed into a new allocation.
+			b.Put(uint8(k), n*blockSize+k+blockSize)
+		}
+		blocks[n] = b
+	}
+	after := heapAlloc()
+	runtime.KeepAlive(blocks)
+	return float64(after-before) / float64(numBlocks*fill)
+}
+
+func TestEstimatedBytesPerElement(t *testing.T) {
+	const fill = 64
+	bitmapBytes := EstimatedBytesPerElement("BitmapArray", fill)
+	mapBytes := EstimatedBytesPerElement("MapArray", fill)
+	t.Logf("Bytes/element at fill %d: BitmapArray %.1f, MapArray %.1f", fill, bitmapBytes, mapBytes)
+	// Each element is at least its 16-byte interface value plus the 8-byte
+	// boxed int.
+	if bitmapBytes < 24 {
+		t.Errorf("BitmapArray bytes/element %.1f < 24, boxed values not counted", bitmapBytes)
+	}
+	if bitmapBytes >= mapBytes {
+		t.Errorf("BitmapArray bytes/element %.1f not less than MapArray %.1f", bitmapBytes, mapBytes)
+	}
+}
+
+// TestComparisonMatrix measures every array type (filtered by -arraytype) at
+// every fill percentile in one run, and writes the results as a CSV table. It
+// is slow, so only runs when -matrix is set.
+func TestComparisonMatrix(t *testing.T) {
+	if *matrixOut == "" {
+		t.Skip("-matrix not set")
+	}
+	const length = 1 << 20
+	testData := generateTestData(*dataSeed, length, length)
+
+	f, err := os.Create(*matrixOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"array_type", "fill_pct", "put_ns_op", "put_allocs_op", "get_ns_op", "bytes_elem"})
+
+	for _, at := range benchArrayTypes() {
+		for _, p := range FillPercentiles {
+			fillItems := length * p / 100
+			items := testData[:fillItems]
+
+			// Pre-boxed values, so only the array's own allocations are counted.
+			before := heapAlloc()
+			v := NewSparseishVector(length, at.alloc)
+			for _, k := range items {
+				v.Put(k, testValues[k%len(testValues)])
+			}
+			bytesElem := float64(heapAlloc()-before) / float64(v.Count())
+
+			get := testing.Benchmark(func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					v.Get(items[i%fillItems])
+				}
+			})
+			v = nil
+
+			put := testing.Benchmark(func(b *testing.B) {
+				b.ReportAllocs()
+				v := NewSparseishVector(length, at.alloc)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if i > 0 && i%fillItems == 0 {
+						b.StopTimer()
+						v.Clear()
+						b.StartTimer()
+					}
+					k := items[i%fillItems]
+					v.Put(k, testValues[k%len(testValues)])
+				}
+			})
+
+			w.Write([]string{
+				at.name,
+				strconv.Itoa(p),
+				strconv.FormatInt(put.NsPerOp(), 10),
+				strconv.FormatInt(put.AllocsPerOp(), 10),
+				strconv.FormatInt(get.NsPerOp(), 10),
+				strconv.FormatFloat(bytesElem, 'f', 1, 64),
+			})
+			t.Logf("%s/%d%%: put %dns, %d allocs, get %dns, %.1f bytes/elem",
+				at.name, p, put.NsPerOp(), put.AllocsPerOp(), get.NsPerOp(), bytesElem)
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,302 @@
+package vectest
+
+import (
+	"iter"
+	"math/rand"
+	"testing"
+)
+
+const (
+	openAddrMinCap = 4
+	openAddrMaxCap = 256
+
+	openAddrDefaultMaxLoad = 0.75
+)
+
+// OpenAddrArray is a small open-addressing hash table using linear probing. It
+// avoids the per-map overhead of a Go map, while still using space
+// proportional to the number of elements.
+//
+// Since nil values are never stored, a slot with a nil value is empty.
+type OpenAddrArray struct {
+	keys   []uint8
+	values []interface{}
+	count  int
+	// Hash shift for the current capacity.
+	shift uint8
+	// Load factor above which the table grows. Zero means the default.
+	maxLoad float64
+}
+
+// NewOpenAddrArray returns an OpenAddrArray which grows when its load factor
+// would exceed maxLoad, in (0, 1]. A lower maxLoad gives shorter probe
+// sequences, at the cost of more memory. The zero OpenAddrArray uses 3/4.
+func NewOpenAddrArray(maxLoad float64) *OpenAddrArray {
+	if maxLoad <= 0 || maxLoad > 1 {
+		panic("vectest: OpenAddrArray load factor must be in (0, 1]")
+	}
+	return &OpenAddrArray{maxLoad: maxLoad}
+}
+
+func (a *OpenAddrArray) Clear() {
+	*a = OpenAddrArray{maxLoad: a.maxLoad}
+}
+
+// overloaded returns true if n elements in a table with capacity c exceed the
+// maximum load factor.
+func (a *OpenAddrArray) overloaded(n, c int) bool {
+	maxLoad := a.maxLoad
+	if maxLoad == 0 {
+		maxLoad = openAddrDefaultMaxLoad
+	}
+	return float64(n) > float64(c)*maxLoad
+}
+
+// ClearRetain clears the table, but keeps its current capacity.
+func (a *OpenAddrArray) ClearRetain() {
+	for n := range a.values {
+		a.values[n] = nil
+	}
+	a.count = 0
+}
+
+// hash maps i to a slot. Multiplying by an odd constant is a bijection on
+// uint8, and the top bits of the product are used as the slot number. At the
+// maximum capacity, every index has its own slot.
+func (a *OpenAddrArray) hash(i uint8) int {
+	return int((i * 157) >> a.shift)
+}
+
+// find returns the slot holding i, or the empty slot where i would be inserted
+// if it isn't present (-1 if the table is full).
+func (a *OpenAddrArray) find(i uint8) (slot int, found bool) {
+	mask := len(a.keys) - 1
+	slot = a.hash(i)
+	for n := 0; n < len(a.keys); n++ {
+		if a.values[slot] == nil {
+			return slot, false
+		}
+		if a.keys[slot] == i {
+			return slot, true
+		}
+		slot = (slot + 1) & mask
+	}
+	return -1, false
+}
+
+func (a *OpenAddrArray) resize(newCap int) {
+	keys, values := a.keys, a.values
+	a.keys = make([]uint8, newCap)
+	a.values = make([]interface{}, newCap)
+	a.shift = 8
+	for c := newCap; c > 1; c >>= 1 {
+		a.shift--
+	}
+	for n, v := range values {
+		if v != nil {
+			slot, _ := a.find(keys[n])
+			a.keys[slot], a.values[slot] = keys[n], v
+		}
+	}
+}
+
+// Reserve grows the table so that n elements fit without further growth.
+func (a *OpenAddrArray) Reserve(n int) {
+	newCap := openAddrMinCap
+	for newCap < openAddrMaxCap && a.overloaded(n, newCap) {
+		newCap *= 2
+	}
+	if newCap > len(a.keys) {
+		a.resize(newCap)
+	}
+}
+
+func (a *OpenAddrArray) Put(i uint8, v interface{}) {
+	slot, found := a.find(i)
+	if found {
+		if v == nil {
+			a.remove(slot)
+		} else {
+			a.values[slot] = v
+		}
+		return
+	} else if v == nil {
+		return
+	}
+
+	if len(a.keys) < openAddrMaxCap && a.overloaded(a.count+1, len(a.keys)) {
+		newCap := 2 * len(a.keys)
+		if newCap < openAddrMinCap {
+			newCap = openAddrMinCap
+		}
+		a.resize(newCap)
+		slot, _ = a.find(i)
+	}
+	a.keys[slot], a.values[slot] = i, v
+	a.count++
+}
+
+// remove deletes the element in slot, shifting back any following elements in
+// the probe sequence so that lookups don't need tombstones.
+func (a *OpenAddrArray) remove(slot int) {
+	mask := len(a.keys) - 1
+	j := slot
+	for n := 1; n < len(a.keys); n++ {
+		j = (j + 1) & mask
+		if a.values[j] == nil {
+			break
+		}
+		// The element at j can only move back to slot if its home slot isn't
+		// (cyclically) in (slot, j].
+		home := a.hash(a.keys[j])
+		if (j > slot && (home <= slot || home > j)) || (j < slot && home <= slot && home > j) {
+			a.keys[slot], a.values[slot] = a.keys[j], a.values[j]
+			slot = j
+		}
+	}
+	a.values[slot] = nil
+	a.count--
+}
+
+// ProbeStats returns the mean and maximum number of slots examined to find
+// each present element, for measuring the effect of the load factor.
+func (a *OpenAddrArray) ProbeStats() (mean float64, max int) {
+	if a.count == 0 {
+		return 0, 0
+	}
+	total := 0
+	for slot, v := range a.values {
+		if v == nil {
+			continue
+		}
+		// Distance from the home slot, wrapping around the table.
+		probes := (slot-a.hash(a.keys[slot]))&(len(a.keys)-1) + 1
+		total += probes
+		if probes > max {
+			max = probes
+		}
+	}
+	return float64(total) / float64(a.count), max
+}
+
+func (a *OpenAddrArray) Get(i uint8) interface{} {
+	if slot, found := a.find(i); found {
+		return a.values[slot]
+	}
+	return nil
+}
+
+func (a *OpenAddrArray) Len() int {
+	return a.count
+}
+
+func (a *OpenAddrArray) Kind() string {
+	return "OpenAddrArray"
+}
+
+func (a *OpenAddrArray) Range(f func(i uint8, v interface{}) bool) {
+	// The table is unordered, so probe every index to iterate in order.
+	for i := 0; i < 256 && a.count > 0; i++ {
+		if v := a.Get(uint8(i)); v != nil {
+			if !f(uint8(i), v) {
+				return
+			}
+		}
+	}
+}
+
+func (a *OpenAddrArray) Clone() Sparse256Array {
+	c := *a
+	c.keys = append([]uint8(nil), a.keys...)
+	c.values = append([]interface{}(nil), a.values...)
+	return &c
+}
+
+// All returns an iterator over the elements, for use with range.
+func (a *OpenAddrArray) All() iter.Seq2[uint8, interface{}] {
+	return a.Range
+}
+
+func TestOpenAddrArray(t *testing.T) {
+	var a OpenAddrArray
+	ref := make(map[uint8]interface{})
+	check := func() {
+		t.Helper()
+		for i := 0; i < 256; i++ {
+			if v := a.Get(uint8(i)); v != ref[uint8(i)] {
+				t.Fatalf("Get(%d) %v != expected %v", i, v, ref[uint8(i)])
+			}
+		}
+		if a.count != len(ref) {
+			t.Fatalf("Count %d != expected %d", a.count, len(ref))
+		}
+	}
+
+	rng := rand.New(rand.NewSource(*dataSeed))
+	for n := 0; n < 20000; n++ {
+		i := uint8(rng.Intn(256))
+		// Bias towards inserts so that the table fills up, then empties.
+		insert := rng.Intn(4) != 0
+		if (n/5000)%2 == 1 {
+			insert = !insert
+		}
+		if insert {
+			a.Put(i, n)
+			ref[i] = n
+		} else {
+			a.Put(i, nil)
+			delete(ref, i)
+		}
+		if n%100 == 0 {
+			check()
+		}
+	}
+	check()
+
+	for i := 0; i < 256; i++ {
+		a.Put(uint8(i), i)
+		ref[uint8(i)] = i
+	}
+	check()
+	if len(a.keys) != openAddrMaxCap {
+		t.Errorf("Capacity %d when full != expected %d", len(a.keys), openAddrMaxCap)
+	}
+	for i := 0; i < 256; i += 2 {
+		a.Put(uint8(i), nil)
+		delete(ref, uint8(i))
+	}
+	check()
+}
+
+func TestOpenAddrArrayLoadFactor(t *testing.T) {
+	keys := rand.New(rand.NewSource(*dataSeed)).Perm(256)[:100]
+	var means []float64
+	var caps []int
+	for _, maxLoad := range []float64{0.5, 0.75, 0.95} {
+		a := NewOpenAddrArray(maxLoad)
+		for _, k := range keys {
+			a.Put(uint8(k), k)
+		}
+		if load := float64(a.Len()) / float64(len(a.keys)); load > maxLoad {
+			t.Errorf("Max load %.2f: Load factor %.2f exceeds maximum", maxLoad, load)
+		}
+		mean, max := a.ProbeStats()
+		t.Logf("Max load %.2f: capacity %d, mean probes %.2f, max probes %d", maxLoad, len(a.keys), mean, max)
+		means = append(means, mean)
+		caps = append(caps, len(a.keys))
+
+		a.Clear()
+		if a.maxLoad != maxLoad {
+			t.Errorf("Max load %.2f: Clear reset max load to %.2f", maxLoad, a.maxLoad)
+		}
+	}
+	for n := 1; n < len(means); n++ {
+		if means[n] < means[n-1] || caps[n] > caps[n-1] {
+			t.Errorf("Higher load factor gave (mean probes %.2f, capacity %d) after (%.2f, %d)",
+				means[n], caps[n], means[n-1], caps[n-1])
+		}
+	}
+	if means[0] >= means[len(means)-1] || caps[0] <= caps[len(caps)-1] {
+		t.Errorf("Load factor had no effect: mean probes %v, capacities %v", means, caps)
+	}
+}
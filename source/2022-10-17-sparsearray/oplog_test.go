@@ -0,0 +1,131 @@
+package vectest
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// An Op is a single Put on a block. A nil Value deletes the element. If Clear
+// is set, the op clears the block instead, and Index and Value are ignored.
+type Op struct {
+	Index uint8
+	Value interface{}
+	Clear bool
+}
+
+// LoggedArray wraps a Sparse256Array and appends every Put to an in-memory op
+// log, so the block can be rebuilt by replaying the log into a fresh array.
+type LoggedArray struct {
+	Sparse256Array
+	log []Op
+}
+
+func NewLoggedArray(a Sparse256Array) *LoggedArray {
+	return &LoggedArray{Sparse256Array: a}
+}
+
+// Replay applies ops to the empty array a, and returns a LoggedArray whose log
+// contains those ops.
+func Replay(a Sparse256Array, ops []Op) *LoggedArray {
+	la := NewLoggedArray(a)
+	for _, op := range ops {
+		if op.Clear {
+			la.Clear()
+		} else {
+			la.Put(op.Index, op.Value)
+		}
+	}
+	return la
+}
+
+// Clear clears the block and logs a Clear op, so a log taken earlier followed
+// by this one still replays to the current contents. The ops logged since the
+// last TakeLog are dropped, since the Clear undoes them.
+func (a *LoggedArray) Clear() {
+	a.Sparse256Array.Clear()
+	a.log = []Op{{Clear: true}}
+}
+
+func (a *LoggedArray) Put(i uint8, v interface{}) {
+	a.log = append(a.log, Op{Index: i, Value: v})
+	a.Sparse256Array.Put(i, v)
+}
+
+// Log returns the ops recorded since the last call to TakeLog.
+func (a *LoggedArray) Log() []Op {
+	return a.log
+}
+
+// TakeLog returns the current op log and truncates it. Subsequent ops are
+// recorded into a new log.
+func (a *LoggedArray) TakeLog() []Op {
+	log := a.log
+	a.log = nil
+	return log
+}
+
+func checkArraysEqual(t *testing.T, name string, a, b Sparse256Array) {
+	t.Helper()
+	for i := 0; i < 256; i++ {
+		if av, bv := a.Get(uint8(i)), b.Get(uint8(i)); av != bv {
+			t.Errorf("%s: Get(%d) %v != expected %v", name, i, bv, av)
+		}
+	}
+}
+
+func TestLoggedArrayReplay(t *testing.T) {
+	rng := rand.New(rand.NewSource(*dataSeed))
+	randomOps := func(n int) []Op {
+		ops := make([]Op, n)
+		for i := range ops {
+			ops[i].Index = uint8(rng.Intn(256))
+			// Roughly one in four ops is a delete.
+			if rng.Intn(4) != 0 {
+				ops[i].Value = rng.Int()
+			}
+		}
+		return ops
+	}
+
+	for _, at := range arrayTypes {
+		a := NewLoggedArray(at.alloc())
+		for _, op := range randomOps(1000) {
+			a.Put(op.Index, op.Value)
+		}
+		first := a.TakeLog()
+		if len(first) != 1000 {
+			t.Errorf("%s: Log length %d != expected 1000", at.name, len(first))
+		}
+		for _, op := range randomOps(500) {
+			a.Put(op.Index, op.Value)
+		}
+		second := a.TakeLog()
+		if len(a.Log()) != 0 {
+			t.Errorf("%s: Log length %d after TakeLog != expected 0", at.name, len(a.Log()))
+		}
+
+		r := Replay(at.alloc(), append(first, second...))
+		checkArraysEqual(t, at.name, a, r)
+		if len(r.Log()) != len(first)+len(second) {
+			t.Errorf("%s: Replayed log length %d != expected %d",
+				at.name, len(r.Log()), len(first)+len(second))
+		}
+
+		// A Clear after a log has been taken must be replayed, or the
+		// cleared elements come back.
+		a.Put(1, "before")
+		a.Put(2, "cleared")
+		a.Clear()
+		a.Put(3, "after")
+		third := a.TakeLog()
+		if len(third) != 2 || !third[0].Clear {
+			t.Errorf("%s: Log after Clear %v != expected a Clear and one Put", at.name, third)
+		}
+		all := append(append(append([]Op(nil), first...), second...), third...)
+		r = Replay(at.alloc(), all)
+		checkArraysEqual(t, at.name, a, r)
+		if r.Len() != 1 || r.Get(3) != "after" {
+			t.Errorf("%s: Replay after Clear (Len %d, Get(3) %v) != expected (1, after)", at.name, r.Len(), r.Get(3))
+		}
+	}
+}
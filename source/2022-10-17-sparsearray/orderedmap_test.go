@@ -0,0 +1,107 @@
+package vectest
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// OrderedIntMap is a map from non-negative ints to non-nil values, with Range
+// in ascending key order. It is backed by a SparseishVector, which grows to fit
+// the largest key Set, so it suits bounded, reasonably dense keyspaces.
+type OrderedIntMap struct {
+	v *SparseishVector
+	n int
+}
+
+func NewOrderedIntMap(allocArray func() Sparse256Array) *OrderedIntMap {
+	return &OrderedIntMap{v: newLazySparseishVector(0, allocArray)}
+}
+
+// Set sets the value for k, or deletes it if v is nil. k must not be negative.
+func (m *OrderedIntMap) Set(k int, v interface{}) {
+	if k < 0 {
+		panic("vectest: negative OrderedIntMap key")
+	} else if k >= m.v.Len() {
+		if v == nil {
+			return
+		}
+		m.v.Grow(k + 1 - m.v.Len())
+	}
+	old := m.v.Get(k)
+	m.v.Put(k, v)
+	if old == nil && v != nil {
+		m.n++
+	} else if old != nil && v == nil {
+		m.n--
+	}
+}
+
+// Get returns the value for k, or nil if it isn't present.
+func (m *OrderedIntMap) Get(k int) interface{} {
+	v, _ := m.v.At(k)
+	return v
+}
+
+func (m *OrderedIntMap) Delete(k int) {
+	if k >= 0 && k < m.v.Len() {
+		m.Set(k, nil)
+	}
+}
+
+// Len returns the number of keys present.
+func (m *OrderedIntMap) Len() int {
+	return m.n
+}
+
+// Range calls f for each key and value in ascending key order, stopping if f
+// returns false.
+func (m *OrderedIntMap) Range(f func(k int, v interface{}) bool) {
+	m.v.Range(f)
+}
+
+func TestOrderedIntMap(t *testing.T) {
+	for _, at := range arrayTypes {
+		rng := rand.New(rand.NewSource(*dataSeed))
+		m := NewOrderedIntMap(at.alloc)
+		ref := make(map[int]interface{})
+		for n := 0; n < 3000; n++ {
+			k := rng.Intn(5000)
+			if rng.Intn(4) == 0 {
+				m.Delete(k)
+				delete(ref, k)
+			} else {
+				m.Set(k, n)
+				ref[k] = n
+			}
+		}
+		m.Delete(-1)
+		m.Delete(1 << 20)
+
+		if m.Len() != len(ref) {
+			t.Errorf("%s: Len %d != expected %d", at.name, m.Len(), len(ref))
+		}
+		for _, k := range []int{-1, 0, 4999, 5000, 1 << 20} {
+			if m.Get(k) != ref[k] {
+				t.Errorf("%s: Get(%d) %v != expected %v", at.name, k, m.Get(k), ref[k])
+			}
+		}
+
+		keys := make([]int, 0, len(ref))
+		for k := range ref {
+			keys = append(keys, k)
+		}
+		sort.Ints(keys)
+		n := 0
+		m.Range(func(k int, v interface{}) bool {
+			if n >= len(keys) || k != keys[n] || v != ref[k] {
+				t.Fatalf("%s: Range element %d (%d, %v) out of order or unexpected", at.name, n, k, v)
+			}
+			n++
+			return true
+		})
+		if n != len(keys) {
+			t.Errorf("%s: Range yielded %d keys != expected %d", at.name, n, len(keys))
+		}
+	}
+}
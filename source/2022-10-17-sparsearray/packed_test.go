@@ -0,0 +1,367 @@
+package vectest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"iter"
+	"math/rand"
+	"testing"
+	"unsafe"
+
+	"github.com/akmistry/go-util/bitmap"
+)
+
+// PackedBitmapArray is a BitmapArray which stores values of type T unboxed in
+// the values slice, avoiding the allocation and pointer indirection of
+// interface{} values. Set/Lookup/Delete are the typed API. Put/Get/Range box
+// values so that it can also be used as a Sparse256Array.
+type PackedBitmapArray[T any] struct {
+	bm     bitmap.Bitmap256
+	values []T
+}
+
+// packedValuesBudget is the largest values slice, in bytes, that
+// NewPackedBitmapArray accepts for the expected fill. Past this, inserts spend
+// most of their time shifting large values along the slice, and append's
+// slack wastes more than boxing would.
+const packedValuesBudget = 16 << 10
+
+var errPackedValueTooLarge = errors.New("vectest: values too large for PackedBitmapArray, use the boxed BitmapArray")
+
+// NewPackedBitmapArray returns an empty PackedBitmapArray with room reserved
+// for fill values. fill is the expected number of elements, or 0 if unknown,
+// which assumes a full block. It returns an error if fill values of type T
+// would take more than packedValuesBudget bytes.
+func NewPackedBitmapArray[T any](fill int) (*PackedBitmapArray[T], error) {
+	if fill <= 0 || fill > blockSize {
+		fill = blockSize
+	}
+	var zero T
+	if size := int(unsafe.Sizeof(zero)) * fill; size > packedValuesBudget {
+		return nil, fmt.Errorf("%w: %d values of %T take %d bytes, over the budget of %d",
+			errPackedValueTooLarge, fill, zero, size, packedValuesBudget)
+	}
+	return &PackedBitmapArray[T]{values: make([]T, 0, fill)}, nil
+}
+
+func (a *PackedBitmapArray[T]) Clear() {
+	a.bm = bitmap.Bitmap256{}
+	a.values = nil
+}
+
+func (a *PackedBitmapArray[T]) Set(i uint8, v T) {
+	index := a.bm.CountLess(i)
+	if a.bm.Get(i) {
+		a.values[index] = v
+		return
+	}
+	a.bm.Set(i)
+	var zero T
+	a.values = append(a.values, zero)
+	copy(a.values[index+1:], a.values[index:])
+	a.values[index] = v
+}
+
+func (a *PackedBitmapArray[T]) Delete(i uint8) {
+	if !a.bm.Get(i) {
+		return
+	}
+	index := a.bm.CountLess(i)
+	a.bm.Clear(i)
+	copy(a.values[index:], a.values[index+1:])
+	var zero T
+	a.values[len(a.values)-1] = zero
+	a.values = a.values[:len(a.values)-1]
+}
+
+func (a *PackedBitmapArray[T]) Lookup(i uint8) (T, bool) {
+	if a.bm.Get(i) {
+		return a.values[a.bm.CountLess(i)], true
+	}
+	var zero T
+	return zero, false
+}
+
+// RangeT is the unboxed equivalent of Range.
+func (a *PackedBitmapArray[T]) RangeT(f func(i uint8, v T) bool) {
+	n := 0
+	bitmapForEach(&a.bm, func(i uint8) bool {
+		n++
+		return f(i, a.values[n-1])
+	})
+}
+
+// Put sets the value at i to v, which must be a T. A nil v deletes.
+func (a *PackedBitmapArray[T]) Put(i uint8, v interface{}) {
+	if v == nil {
+		a.Delete(i)
+	} else {
+		a.Set(i, v.(T))
+	}
+}
+
+func (a *PackedBitmapArray[T]) Get(i uint8) interface{} {
+	if v, ok := a.Lookup(i); ok {
+		return v
+	}
+	return nil
+}
+
+func (a *PackedBitmapArray[T]) Len() int {
+	return a.bm.Count()
+}
+
+func (a *PackedBitmapArray[T]) Kind() string {
+	return "PackedBitmapArray"
+}
+
+func (a *PackedBitmapArray[T]) Range(f func(i uint8, v interface{}) bool) {
+	a.RangeT(func(i uint8, v T) bool {
+		return f(i, v)
+	})
+}
+
+// All returns an iterator over the elements, for use with range.
+func (a *PackedBitmapArray[T]) All() iter.Seq2[uint8, interface{}] {
+	return a.Range
+}
+
+// MarshalBinary encodes the array as its 32-byte presence bitmap followed by
+// the values in index order, little-endian. T must be a fixed-size type, as
+// understood by encoding/binary, so that each value has the same encoded size.
+func (a *PackedBitmapArray[T]) MarshalBinary() ([]byte, error) {
+	buf := bytes.NewBuffer(BitmapBytes(&a.bm))
+	if err := binary.Write(buf, binary.LittleEndian, a.values); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (a *PackedBitmapArray[T]) UnmarshalBinary(data []byte) error {
+	if len(data) < 32 {
+		return errCorruptBlock
+	}
+	var bm bitmap.Bitmap256
+	for i := range bm {
+		bm[i] = binary.LittleEndian.Uint64(data[i*8:])
+	}
+	values := make([]T, bm.Count())
+	if binary.Size(values) != len(data)-32 {
+		return errCorruptBlock
+	}
+	if err := binary.Read(bytes.NewReader(data[32:]), binary.LittleEndian, values); err != nil {
+		return err
+	}
+	a.bm, a.values = bm, values
+	return nil
+}
+
+// Number is the set of value types which Sum can add.
+type Number interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr |
+		~float32 | ~float64
+}
+
+// Sum returns the sum of all values in v, which must be of type T. Blocks which
+// are a *PackedBitmapArray[T] are summed directly from their values slice,
+// without boxing. Other blocks fall back to Range.
+func Sum[T Number](v *SparseishVector) T {
+	var sum T
+	for _, b := range v.blocks {
+		if b == nil {
+			continue
+		} else if pa, ok := b.(*PackedBitmapArray[T]); ok {
+			for _, x := range pa.values {
+				sum += x
+			}
+			continue
+		}
+		b.Range(func(_ uint8, x interface{}) bool {
+			sum += x.(T)
+			return true
+		})
+	}
+	return sum
+}
+
+func TestPackedBitmapArray(t *testing.T) {
+	var a PackedBitmapArray[int]
+	ref := make(map[uint8]int)
+	rng := rand.New(rand.NewSource(*dataSeed))
+	for n := 0; n < 5000; n++ {
+		i := uint8(rng.Intn(256))
+		if rng.Intn(3) == 0 {
+			a.Delete(i)
+			delete(ref, i)
+		} else {
+			a.Set(i, n)
+			ref[i] = n
+		}
+	}
+	for i := 0; i < 256; i++ {
+		v, ok := a.Lookup(uint8(i))
+		rv, rok := ref[uint8(i)]
+		if v != rv || ok != rok {
+			t.Errorf("Lookup(%d) (%d, %v) != expected (%d, %v)", i, v, ok, rv, rok)
+		}
+		if rok && a.Get(uint8(i)) != rv {
+			t.Errorf("Get(%d) %v != expected %d", i, a.Get(uint8(i)), rv)
+		} else if !rok && a.Get(uint8(i)) != nil {
+			t.Errorf("Get(%d) %v != expected nil", i, a.Get(uint8(i)))
+		}
+	}
+	count := 0
+	a.RangeT(func(i uint8, v int) bool {
+		if ref[i] != v {
+			t.Errorf("RangeT value at %d %d != expected %d", i, v, ref[i])
+		}
+		count++
+		return true
+	})
+	if count != len(ref) {
+		t.Errorf("RangeT count %d != expected %d", count, len(ref))
+	}
+
+	// Used through the Sparse256Array interface.
+	var sa Sparse256Array = &a
+	sa.Put(7, 1234)
+	sa.Put(8, nil)
+	if sa.Get(7) != 1234 || sa.Get(8) != nil {
+		t.Errorf("Sparse256Array Get (%v, %v) != expected (1234, nil)", sa.Get(7), sa.Get(8))
+	}
+}
+
+func TestNewPackedBitmapArray(t *testing.T) {
+	a, err := NewPackedBitmapArray[int64](100)
+	if err != nil {
+		t.Fatalf("NewPackedBitmapArray[int64](100) error: %v", err)
+	} else if cap(a.values) != 100 || a.Len() != 0 {
+		t.Errorf("NewPackedBitmapArray[int64](100) (cap %d, Len %d) != expected (100, 0)", cap(a.values), a.Len())
+	}
+	// A full block of 64-byte values is exactly on budget.
+	if _, err := NewPackedBitmapArray[[64]byte](0); err != nil {
+		t.Errorf("NewPackedBitmapArray[[64]byte](0) error: %v", err)
+	}
+
+	type bigValue struct {
+		data [1024]byte
+	}
+	for _, fill := range []int{0, 17, 256} {
+		if _, err := NewPackedBitmapArray[bigValue](fill); !errors.Is(err, errPackedValueTooLarge) {
+			t.Errorf("NewPackedBitmapArray[bigValue](%d) error %v, expected %v", fill, err, errPackedValueTooLarge)
+		}
+	}
+	// A small enough fill hint keeps large values within budget.
+	if _, err := NewPackedBitmapArray[bigValue](16); err != nil {
+		t.Errorf("NewPackedBitmapArray[bigValue](16) error: %v", err)
+	}
+}
+
+func BenchmarkPackedBitmapArray(b *testing.B) {
+	for _, fill := range []int{16, 64, 128, 256} {
+		keys := rand.New(rand.NewSource(*dataSeed)).Perm(256)[:fill]
+
+		b.Run(fmt.Sprintf("Put/%d/BitmapArray", fill), func(b *testing.B) {
+			var a BitmapArray
+			for i := 0; i < b.N; i++ {
+				if i%fill == 0 {
+					a.Clear()
+				}
+				a.Put(uint8(keys[i%fill]), i)
+			}
+		})
+		b.Run(fmt.Sprintf("Put/%d/PackedBitmapArray", fill), func(b *testing.B) {
+			var a PackedBitmapArray[int]
+			for i := 0; i < b.N; i++ {
+				if i%fill == 0 {
+					a.Clear()
+				}
+				a.Set(uint8(keys[i%fill]), i)
+			}
+		})
+
+		b.Run(fmt.Sprintf("Get/%d/BitmapArray", fill), func(b *testing.B) {
+			var a BitmapArray
+			for _, k := range keys {
+				a.Put(uint8(k), k)
+			}
+			b.ResetTimer()
+			sum := 0
+			for i := 0; i < b.N; i++ {
+				if v := a.Get(uint8(i)); v != nil {
+					sum += v.(int)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("Get/%d/PackedBitmapArray", fill), func(b *testing.B) {
+			var a PackedBitmapArray[int]
+			for _, k := range keys {
+				a.Set(uint8(k), k)
+			}
+			b.ResetTimer()
+			sum := 0
+			for i := 0; i < b.N; i++ {
+				v, _ := a.Lookup(uint8(i))
+				sum += v
+			}
+		})
+	}
+}
+
+func TestSum(t *testing.T) {
+	const length = 5*blockSize + 17
+	testData := generateTestData(*dataSeed, 500, length)
+	allocs := []arrayType{
+		{"PackedBitmapArray", func() Sparse256Array { return new(PackedBitmapArray[int64]) }},
+		{"BitmapArray", func() Sparse256Array { return new(BitmapArray) }},
+	}
+	for _, at := range allocs {
+		v := NewSparseishVector(length, at.alloc)
+		var expected int64
+		for _, k := range testData {
+			if v.Get(k) == nil {
+				expected += int64(k)
+			}
+			v.Put(k, int64(k))
+		}
+		if sum := Sum[int64](v); sum != expected {
+			t.Errorf("%s: Sum %d != expected %d", at.name, sum, expected)
+		}
+		count := 0
+		v.Range(func(int, interface{}) bool {
+			count++
+			return true
+		})
+		if v.Count() != count {
+			t.Errorf("%s: Count %d != expected %d", at.name, v.Count(), count)
+		}
+	}
+}
+
+func BenchmarkSum(b *testing.B) {
+	const length = 1 << 20
+	v := NewSparseishVector(length, func() Sparse256Array {
+		return new(PackedBitmapArray[int64])
+	})
+	for _, k := range generateTestData(*dataSeed, length/4, length) {
+		v.Put(k, int64(k))
+	}
+
+	b.Run("Range", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var sum int64
+			v.Range(func(_ int, x interface{}) bool {
+				sum += x.(int64)
+				return true
+			})
+		}
+	})
+	b.Run("Sum", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			Sum[int64](v)
+		}
+	})
+}
@@ -0,0 +1,334 @@
+package vectest
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// Each bit of a block digest covers 1<<digestShift consecutive indices.
+const digestShift = blockBits - 6
+
+// PrefilterVector is a SparseishVector which keeps a summary bitmap with a bit
+// set for each block that may be non-empty, and a 64-bit digest per block with
+// a bit set for each group of 4 indices that may contain an element.
+// MayContain can reject most absent indices with a bit check, without touching
+// the block.
+//
+// The vector isn't embedded, so every method which adds elements goes through
+// the digest. Methods which only delete may leave bits set, which only makes
+// MayContain more conservative.
+type PrefilterVector struct {
+	v       *SparseishVector
+	summary []uint64
+	digests []uint64
+}
+
+func NewPrefilterVector(length int, allocArray func() Sparse256Array) *PrefilterVector {
+	p := &PrefilterVector{v: NewSparseishVector(length, allocArray)}
+	p.resizeDigests()
+	return p
+}
+
+func digestBit(i int) uint64 {
+	return 1 << ((i & blockMask) >> digestShift)
+}
+
+// resizeDigests sizes the summary and digests to the vector's blocks, after it
+// has been grown or shrunk.
+func (p *PrefilterVector) resizeDigests() {
+	numBlocks := len(p.v.blocks)
+	if numBlocks < len(p.digests) {
+		p.digests = p.digests[:numBlocks]
+	} else {
+		p.digests = append(p.digests, make([]uint64, numBlocks-len(p.digests))...)
+	}
+	numWords := (numBlocks + 63) / 64
+	if numWords < len(p.summary) {
+		p.summary = p.summary[:numWords]
+	} else {
+		p.summary = append(p.summary, make([]uint64, numWords-len(p.summary))...)
+	}
+	// Clear summary bits beyond the last block, which may have been shrunk
+	// away.
+	if numBlocks%64 != 0 {
+		p.summary[numWords-1] &= 1<<(numBlocks%64) - 1
+	}
+}
+
+// mark sets the digest and summary bits for i.
+func (p *PrefilterVector) mark(i int) {
+	bi := i >> blockBits
+	p.digests[bi] |= digestBit(i)
+	p.summary[bi/64] |= 1 << (bi % 64)
+}
+
+// rebuildDigests recomputes the summary and digests from the vector's
+// contents.
+func (p *PrefilterVector) rebuildDigests() {
+	p.resizeDigests()
+	clear(p.digests)
+	clear(p.summary)
+	p.v.Range(func(i int, _ interface{}) bool {
+		p.mark(i)
+		return true
+	})
+}
+
+// MayContain returns false if i is definitely not present. The summary bit for
+// i's block is checked first, so indices in empty blocks are rejected without
+// loading the block's digest.
+func (p *PrefilterVector) MayContain(i int) bool {
+	bi := i >> blockBits
+	if i < 0 || bi >= len(p.digests) || p.summary[bi/64]&(1<<(bi%64)) == 0 {
+		return false
+	}
+	return p.digests[bi]&digestBit(i) != 0
+}
+
+func (p *PrefilterVector) Len() int {
+	return p.v.Len()
+}
+
+// Count returns the number of present elements.
+func (p *PrefilterVector) Count() int {
+	return p.v.Count()
+}
+
+func (p *PrefilterVector) Grow(n int) {
+	p.v.Grow(n)
+	p.resizeDigests()
+}
+
+func (p *PrefilterVector) Clear() {
+	p.v.Clear()
+	clear(p.digests)
+	clear(p.summary)
+}
+
+func (p *PrefilterVector) Get(i int) interface{} {
+	return p.v.Get(i)
+}
+
+func (p *PrefilterVector) At(i int) (interface{}, bool) {
+	return p.v.At(i)
+}
+
+func (p *PrefilterVector) Put(i int, val interface{}) {
+	p.v.Put(i, val)
+	if val != nil {
+		p.mark(i)
+		return
+	}
+	bi, bit := i>>blockBits, digestBit(i)
+	if p.digests[bi]&bit == 0 {
+		return
+	}
+	// Clear the bit if the rest of the group is also empty. Groups never
+	// cross a block, so the scan stays within Cap, which can include
+	// elements past Len.
+	first := i &^ (1<<digestShift - 1)
+	for j := first; j < first+1<<digestShift; j++ {
+		if p.v.Get(j) != nil {
+			return
+		}
+	}
+	p.digests[bi] &^= bit
+	if p.digests[bi] == 0 {
+		p.summary[bi/64] &^= 1 << (bi % 64)
+	}
+}
+
+func (p *PrefilterVector) Delete(i int) {
+	p.Put(i, nil)
+}
+
+// GetOrCompute is SparseishVector.GetOrCompute, marking i if a value is
+// stored.
+func (p *PrefilterVector) GetOrCompute(i int, load func() interface{}) interface{} {
+	val := p.v.GetOrCompute(i, load)
+	if val != nil {
+		p.mark(i)
+	}
+	return val
+}
+
+// FillRange is SparseishVector.FillRange, marking every group in [lo, hi). A
+// nil val leaves the digests unchanged.
+func (p *PrefilterVector) FillRange(lo, hi int, val interface{}) {
+	p.v.FillRange(lo, hi, val)
+	if val == nil {
+		return
+	}
+	for i := lo; i < hi; i = (i | (1<<digestShift - 1)) + 1 {
+		p.mark(i)
+	}
+}
+
+// Map is SparseishVector.Map. It can only replace or delete elements, so the
+// digests are left unchanged.
+func (p *PrefilterVector) Map(f func(i int, v interface{}) interface{}) {
+	p.v.Map(f)
+}
+
+func (p *PrefilterVector) Range(f func(i int, v interface{}) bool) {
+	p.v.Range(f)
+}
+
+func (p *PrefilterVector) WriteTo(w io.Writer) (int64, error) {
+	return p.v.WriteTo(w)
+}
+
+// ReadFrom is SparseishVector.ReadFrom, rebuilding the digests from the read
+// vector.
+func (p *PrefilterVector) ReadFrom(r io.Reader) (int64, error) {
+	n, err := p.v.ReadFrom(r)
+	p.rebuildDigests()
+	return n, err
+}
+
+// ApplyDeltaStream is SparseishVector.ApplyDeltaStream, rebuilding the digests
+// afterwards.
+func (p *PrefilterVector) ApplyDeltaStream(r io.Reader) error {
+	err := p.v.ApplyDeltaStream(r)
+	p.rebuildDigests()
+	return err
+}
+
+// checkNoFalseNegatives reports an error for every present element for which
+// MayContain returns false.
+func checkNoFalseNegatives(t *testing.T, name string, p *PrefilterVector) {
+	t.Helper()
+	p.Range(func(i int, _ interface{}) bool {
+		if !p.MayContain(i) {
+			t.Errorf("%s: MayContain(%d) false for present element", name, i)
+		}
+		return true
+	})
+}
+
+func TestPrefilterVector(t *testing.T) {
+	const length = 100 * blockSize
+	rng := rand.New(rand.NewSource(*dataSeed))
+	for _, fill := range []int{1, 10, 50} {
+		v := NewPrefilterVector(length, arrayTypes[0].alloc)
+		present := make(map[int]bool)
+		for _, k := range generateTestData(*dataSeed, length*fill/100, length) {
+			v.Put(k, k)
+			present[k] = true
+		}
+		// Delete some elements, to check the digest is maintained.
+		for k := range present {
+			if rng.Intn(4) == 0 {
+				v.Delete(k)
+				delete(present, k)
+			}
+		}
+
+		falsePositives := 0
+		for i := 0; i < length; i++ {
+			may := v.MayContain(i)
+			if present[i] && !may {
+				t.Errorf("Fill %d%%: MayContain(%d) false for present element", fill, i)
+			} else if !present[i] && may {
+				falsePositives++
+			}
+		}
+		t.Logf("Fill %d%%: false positive rate %.3f", fill,
+			float64(falsePositives)/float64(length-len(present)))
+
+		for k := range present {
+			v.Delete(k)
+		}
+		for i := 0; i < length; i++ {
+			if v.MayContain(i) {
+				t.Fatalf("Fill %d%%: MayContain(%d) true after deleting all elements", fill, i)
+			}
+		}
+		for w, bits := range v.summary {
+			if bits != 0 {
+				t.Errorf("Fill %d%%: Summary word %d %x after deleting all elements, expected 0", fill, w, bits)
+			}
+		}
+	}
+
+	v := NewPrefilterVector(blockSize, arrayTypes[0].alloc)
+	v.Grow(blockSize)
+	v.Put(blockSize+1, 1)
+	if !v.MayContain(blockSize+1) || v.MayContain(blockSize+5) || v.MayContain(10*blockSize) || v.MayContain(-1) {
+		t.Errorf("MayContain after Grow (%v, %v, %v, %v) != expected (true, false, false, false)",
+			v.MayContain(blockSize+1), v.MayContain(blockSize+5), v.MayContain(10*blockSize), v.MayContain(-1))
+	}
+}
+
+func TestPrefilterVectorPastLen(t *testing.T) {
+	// Put accepts indices in [Len, Cap), which share a group with indices
+	// below Len.
+	v := NewPrefilterVector(blockSize+2, arrayTypes[0].alloc)
+	v.Put(blockSize+1, 1)
+	v.Put(blockSize+3, 3)
+	v.Delete(blockSize + 1)
+	if !v.MayContain(blockSize + 3) {
+		t.Errorf("MayContain(%d) false for present element past Len", blockSize+3)
+	}
+	v.Delete(blockSize + 3)
+	if v.MayContain(blockSize + 3) {
+		t.Errorf("MayContain(%d) true after deleting the group", blockSize+3)
+	}
+}
+
+func TestPrefilterVectorAddingMethods(t *testing.T) {
+	const length = 200 * blockSize
+	for _, at := range arrayTypes {
+		v := NewPrefilterVector(length, at.alloc)
+		v.GetOrCompute(10, func() interface{} { return 10 })
+		v.GetOrCompute(13, func() interface{} { return nil })
+		v.FillRange(300, 310, 2)
+		v.FillRange(100*blockSize-3, 101*blockSize+5, 3)
+		checkNoFalseNegatives(t, at.name+" GetOrCompute/FillRange", v)
+		if v.MayContain(13) || v.MayContain(290) {
+			t.Errorf("%s: MayContain (%v, %v) for absent elements != expected (false, false)",
+				at.name, v.MayContain(13), v.MayContain(290))
+		}
+
+		v.Map(func(i int, val interface{}) interface{} {
+			if i%2 == 0 {
+				return nil
+			}
+			return i
+		})
+		checkNoFalseNegatives(t, at.name+" Map", v)
+
+		// A delta which adds elements in a new, larger vector.
+		mod := NewSparseishVector(length+blockSize, at.alloc)
+		v.Range(func(i int, val interface{}) bool {
+			mod.Put(i, val)
+			return true
+		})
+		for _, k := range generateTestData(*dataSeed, 500, length+blockSize) {
+			mod.Put(k, k)
+		}
+		var delta bytes.Buffer
+		if _, err := mod.SerializeDelta(v.v, &delta); err != nil {
+			t.Fatalf("%s: SerializeDelta error: %v", at.name, err)
+		}
+		if err := v.ApplyDeltaStream(&delta); err != nil {
+			t.Fatalf("%s: ApplyDeltaStream error: %v", at.name, err)
+		}
+		if v.Count() != mod.Count() {
+			t.Errorf("%s: Count after ApplyDeltaStream %d != expected %d", at.name, v.Count(), mod.Count())
+		}
+		checkNoFalseNegatives(t, at.name+" ApplyDeltaStream", v)
+
+		var buf bytes.Buffer
+		if _, err := v.WriteTo(&buf); err != nil {
+			t.Fatalf("%s: WriteTo error: %v", at.name, err)
+		}
+		r := NewPrefilterVector(0, at.alloc)
+		if _, err := r.ReadFrom(&buf); err != nil {
+			t.Fatalf("%s: ReadFrom error: %v", at.name, err)
+		}
+		checkNoFalseNegatives(t, at.name+" ReadFrom", r)
+	}
+}
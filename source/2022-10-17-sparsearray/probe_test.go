@@ -0,0 +1,74 @@
+package vectest
+
+import (
+	"math"
+	"sort"
+	"testing"
+)
+
+// ProbedBinaryArray is a BinaryArray which counts the index comparisons made
+// by the binary search in Get, to relate Get cost to block occupancy. It is
+// separate from BinaryArray so the counters don't add to every block's size.
+type ProbedBinaryArray struct {
+	BinaryArray
+	gets        int
+	comparisons int
+}
+
+func (a *ProbedBinaryArray) Get(i uint8) interface{} {
+	a.gets++
+	index := sort.Search(len(a.items), func(n int) bool {
+		a.comparisons++
+		return a.items[n].index >= i
+	})
+	if index < len(a.items) && a.items[index].index == i {
+		return a.items[index].v
+	}
+	return nil
+}
+
+// ProbeStats returns the number of Gets since the last ResetStats, and the
+// mean number of comparisons each made.
+func (a *ProbedBinaryArray) ProbeStats() (gets int, mean float64) {
+	if a.gets == 0 {
+		return 0, 0
+	}
+	return a.gets, float64(a.comparisons) / float64(a.gets)
+}
+
+func (a *ProbedBinaryArray) ResetStats() {
+	a.gets, a.comparisons = 0, 0
+}
+
+func (a *ProbedBinaryArray) Kind() string {
+	return "ProbedBinaryArray"
+}
+
+func TestProbedBinaryArray(t *testing.T) {
+	var a ProbedBinaryArray
+	if gets, mean := a.ProbeStats(); gets != 0 || mean != 0 {
+		t.Errorf("Initial ProbeStats (%d, %f) != expected (0, 0)", gets, mean)
+	}
+	for _, fill := range []int{1, 2, 4, 16, 64, 256} {
+		a.Clear()
+		// Evenly spaced, so the probe sequences are representative.
+		for n := 0; n < fill; n++ {
+			a.Put(uint8(n*256/fill), n)
+		}
+		a.ResetStats()
+		for i := 0; i < 256; i++ {
+			a.Get(uint8(i))
+		}
+		gets, mean := a.ProbeStats()
+		t.Logf("Fill %d: mean comparisons %.2f", fill, mean)
+		if gets != 256 {
+			t.Errorf("Fill %d: Gets %d != expected 256", fill, gets)
+		}
+		// A binary search over n items takes floor(log2(n))+1 comparisons,
+		// give or take one.
+		expected := math.Floor(math.Log2(float64(fill))) + 1
+		if math.Abs(mean-expected) > 1 {
+			t.Errorf("Fill %d: Mean comparisons %.2f not within 1 of %.0f", fill, mean, expected)
+		}
+	}
+}
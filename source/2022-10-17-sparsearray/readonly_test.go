@@ -0,0 +1,128 @@
+package vectest
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/akmistry/go-util/bitmap"
+)
+
+var ErrReadOnly = errors.New("vectest: array is read-only")
+
+// ReadOnlyBitmapArray reads int64 values directly from the output of
+// PackedBitmapArray[int64].MarshalBinary, without decoding it into slices. The
+// data can come from anywhere, such as an mmap'd file, and is never copied.
+type ReadOnlyBitmapArray struct {
+	bm   bitmap.Bitmap256
+	data []byte
+}
+
+func NewReadOnlyBitmapArray(data []byte) (*ReadOnlyBitmapArray, error) {
+	if len(data) < 32 {
+		return nil, errCorruptBlock
+	}
+	a := &ReadOnlyBitmapArray{data: data[32:]}
+	for i := range a.bm {
+		a.bm[i] = binary.LittleEndian.Uint64(data[i*8:])
+	}
+	if len(a.data) != a.bm.Count()*8 {
+		return nil, errCorruptBlock
+	}
+	return a, nil
+}
+
+func (a *ReadOnlyBitmapArray) value(n int) int64 {
+	return int64(binary.LittleEndian.Uint64(a.data[n*8:]))
+}
+
+func (a *ReadOnlyBitmapArray) Get(i uint8) (int64, bool) {
+	if a.bm.Get(i) {
+		return a.value(a.bm.CountLess(i)), true
+	}
+	return 0, false
+}
+
+func (a *ReadOnlyBitmapArray) Range(f func(i uint8, v int64) bool) {
+	n := 0
+	bitmapForEach(&a.bm, func(i uint8) bool {
+		n++
+		return f(i, a.value(n-1))
+	})
+}
+
+// Keys returns the present indices in ascending order.
+func (a *ReadOnlyBitmapArray) Keys() []uint8 {
+	keys := make([]uint8, 0, a.bm.Count())
+	bitmapForEach(&a.bm, func(i uint8) bool {
+		keys = append(keys, i)
+		return true
+	})
+	return keys
+}
+
+// Put always returns ErrReadOnly.
+func (a *ReadOnlyBitmapArray) Put(i uint8, v int64) error {
+	return ErrReadOnly
+}
+
+func TestReadOnlyBitmapArray(t *testing.T) {
+	rng := rand.New(rand.NewSource(*dataSeed))
+	var orig PackedBitmapArray[int64]
+	for _, k := range rng.Perm(256)[:100] {
+		orig.Set(uint8(k), rng.Int63()-rng.Int63())
+	}
+	data, err := orig.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary error: %v", err)
+	}
+
+	a, err := NewReadOnlyBitmapArray(data)
+	if err != nil {
+		t.Fatalf("NewReadOnlyBitmapArray error: %v", err)
+	}
+	for i := 0; i < 256; i++ {
+		v, ok := a.Get(uint8(i))
+		ov, ook := orig.Lookup(uint8(i))
+		if v != ov || ok != ook {
+			t.Errorf("Get(%d) (%d, %v) != expected (%d, %v)", i, v, ok, ov, ook)
+		}
+	}
+	keys := a.Keys()
+	if len(keys) != 100 {
+		t.Errorf("Keys length %d != expected 100", len(keys))
+	}
+	n := 0
+	a.Range(func(i uint8, v int64) bool {
+		if n < len(keys) && keys[n] != i {
+			t.Errorf("Range index %d %d != Keys %d", n, i, keys[n])
+		}
+		if ov, _ := orig.Lookup(i); v != ov {
+			t.Errorf("Range value at %d %d != expected %d", i, v, ov)
+		}
+		n++
+		return true
+	})
+	if err := a.Put(1, 1); err != ErrReadOnly {
+		t.Errorf("Put error %v != expected %v", err, ErrReadOnly)
+	}
+
+	var rt PackedBitmapArray[int64]
+	if err := rt.UnmarshalBinary(data); err != nil {
+		t.Errorf("UnmarshalBinary error: %v", err)
+	}
+	for _, k := range keys {
+		v, _ := rt.Lookup(k)
+		ov, _ := orig.Lookup(k)
+		if v != ov {
+			t.Errorf("Unmarshalled value at %d %d != expected %d", k, v, ov)
+		}
+	}
+
+	for _, bad := range [][]byte{nil, data[:31], data[:len(data)-1]} {
+		if _, err := NewReadOnlyBitmapArray(bad); err == nil {
+			t.Errorf("NewReadOnlyBitmapArray of %d bytes succeeded", len(bad))
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package vectest
+
+import (
+	"testing"
+)
+
+// storedNil is stored in the underlying vector in place of a nil value.
+type storedNil struct{}
+
+// SentinelVector is a SparseishVector where a caller-chosen sentinel value,
+// rather than nil, marks an absent element. This allows nil to be stored as a
+// value. Putting the sentinel deletes, and Get returns the sentinel for absent
+// elements. The sentinel must be comparable.
+//
+// Only Put, Get and Delete translate values. Other methods, such as Range, see
+// the underlying representation, where a stored nil is storedNil{}.
+type SentinelVector struct {
+	*SparseishVector
+	sentinel interface{}
+}
+
+func NewSentinelVector(length int, sentinel interface{}, allocArray func() Sparse256Array) *SentinelVector {
+	return &SentinelVector{
+		SparseishVector: NewSparseishVector(length, allocArray),
+		sentinel:        sentinel,
+	}
+}
+
+func (v *SentinelVector) Put(i int, val interface{}) {
+	if val == v.sentinel {
+		val = nil
+	} else if val == nil {
+		val = storedNil{}
+	}
+	v.SparseishVector.Put(i, val)
+}
+
+func (v *SentinelVector) Get(i int) interface{} {
+	switch val := v.SparseishVector.Get(i); val {
+	case nil:
+		return v.sentinel
+	case storedNil{}:
+		return nil
+	default:
+		return val
+	}
+}
+
+func (v *SentinelVector) Delete(i int) {
+	v.SparseishVector.Put(i, nil)
+}
+
+func TestSentinelVector(t *testing.T) {
+	type deleted struct{}
+	for _, at := range arrayTypes {
+		v := NewSentinelVector(4*blockSize, deleted{}, at.alloc)
+		if got := v.Get(10); got != (deleted{}) {
+			t.Errorf("%s: Get(10) of absent element %v != expected sentinel", at.name, got)
+		}
+
+		v.Put(10, nil)
+		v.Put(300, 300)
+		if got := v.Get(10); got != nil {
+			t.Errorf("%s: Get(10) %v != expected nil", at.name, got)
+		}
+		if got := v.Get(300); got != 300 {
+			t.Errorf("%s: Get(300) %v != expected 300", at.name, got)
+		}
+		if c := v.Count(); c != 2 {
+			t.Errorf("%s: Count %d != expected 2", at.name, c)
+		}
+
+		v.Put(300, deleted{})
+		v.Delete(10)
+		for _, i := range []int{10, 300} {
+			if got := v.Get(i); got != (deleted{}) {
+				t.Errorf("%s: Get(%d) after delete %v != expected sentinel", at.name, i, got)
+			}
+		}
+		if c := v.Count(); c != 0 {
+			t.Errorf("%s: Count %d after deletes != expected 0", at.name, c)
+		}
+	}
+}
@@ -0,0 +1,673 @@
+package vectest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/akmistry/go-util/bitmap"
+)
+
+// Block serialization
+//
+// A block is encoded as a 1-byte tag identifying its type, followed by its
+// 32-byte presence bitmap and the values of the present elements (in index
+// order) gob-encoded as a []interface{}. A nil block is encoded as just its
+// tag. A single gob stream is shared by all blocks in a vector, so type
+// information is only sent once. Value types other than the gob built-ins must
+// be registered with gob.Register.
+
+var errCorruptBlock = errors.New("vectest: corrupt block encoding")
+
+// maxReadLength is the largest vector length ReadFrom and ApplyDeltaStream
+// accept, so a corrupt length can't cause a huge allocation. The blocks slice
+// for a vector this long takes 256 MiB on 64-bit platforms.
+const maxReadLength = 1 << 32
+
+// readLength reads a vector length written as a uvarint, rejecting lengths
+// that are too large.
+func readLength(r io.ByteReader) (int, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, fmt.Errorf("vectest: reading vector length: %w", unexpectedEOF(err))
+	} else if length > maxReadLength || length > math.MaxInt-blockMask {
+		return 0, errCorruptBlock
+	}
+	return int(length), nil
+}
+
+const (
+	blockTagNil = iota
+	// A block of a type without its own tag, which is decoded into a block
+	// from the vector's allocator.
+	blockTagAlloc
+	blockTagMapArray
+	blockTagBinaryArray
+	blockTagSplitBinaryArray
+	blockTagBitmapArray
+	blockTagOpenAddrArray
+)
+
+func blockTag(b Sparse256Array) byte {
+	switch b.(type) {
+	case nil:
+		return blockTagNil
+	case *MapArray:
+		return blockTagMapArray
+	case *BinaryArray:
+		return blockTagBinaryArray
+	case *SplitBinaryArray:
+		return blockTagSplitBinaryArray
+	case *BitmapArray:
+		return blockTagBitmapArray
+	case *OpenAddrArray:
+		return blockTagOpenAddrArray
+	}
+	return blockTagAlloc
+}
+
+// newTaggedBlock returns a new block for tag, which must be one of the concrete
+// type tags.
+func newTaggedBlock(tag byte) Sparse256Array {
+	switch tag {
+	case blockTagMapArray:
+		return &MapArray{m: make(map[uint8]interface{})}
+	case blockTagBinaryArray:
+		return &BinaryArray{}
+	case blockTagSplitBinaryArray:
+		return &SplitBinaryArray{}
+	case blockTagBitmapArray:
+		return &BitmapArray{}
+	case blockTagOpenAddrArray:
+		return &OpenAddrArray{}
+	}
+	return nil
+}
+
+type blockEncoder struct {
+	w      io.Writer
+	enc    *gob.Encoder
+	values []interface{}
+}
+
+func newBlockEncoder(w io.Writer) *blockEncoder {
+	return &blockEncoder{w: w, enc: gob.NewEncoder(w)}
+}
+
+func (e *blockEncoder) encode(b Sparse256Array) error {
+	tag := blockTag(b)
+	if _, err := e.w.Write([]byte{tag}); err != nil || tag == blockTagNil {
+		return err
+	}
+	bm := blockBitmap(b)
+	e.values = e.values[:0]
+	b.Range(func(_ uint8, v interface{}) bool {
+		e.values = append(e.values, v)
+		return true
+	})
+	if _, err := e.w.Write(BitmapBytes(&bm)); err != nil {
+		return err
+	}
+	return e.enc.Encode(e.values)
+}
+
+// byteReader is an io.Reader which can also read single bytes, as gob needs
+// to avoid adding its own buffering.
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// byteCountingReader counts the bytes consumed from a byteReader. It is an
+// io.ByteReader itself, so gob reads from it directly without adding its own
+// buffering.
+type byteCountingReader struct {
+	r byteReader
+	n int64
+}
+
+func (r *byteCountingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *byteCountingReader) ReadByte() (byte, error) {
+	c, err := r.r.ReadByte()
+	if err == nil {
+		r.n++
+	}
+	return c, err
+}
+
+type blockDecoder struct {
+	r      *byteCountingReader
+	dec    *gob.Decoder
+	values []interface{}
+}
+
+// newBlockDecoder returns a decoder reading from r. If r is an io.ByteReader,
+// such as a bytes.Reader or bufio.Reader, it is read directly and nothing past
+// the encoded data is consumed. Otherwise it is wrapped in a bufio.Reader,
+// which may read ahead.
+func newBlockDecoder(r io.Reader) *blockDecoder {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	cr := &byteCountingReader{r: br}
+	return &blockDecoder{r: cr, dec: gob.NewDecoder(cr)}
+}
+
+// decode returns the next encoded block. b is reused if it has the encoded
+// type, and alloc is used for blocks without their own type tag.
+func (d *blockDecoder) decode(b Sparse256Array, alloc func() Sparse256Array) (Sparse256Array, error) {
+	tag, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case tag == blockTagNil:
+		return nil, nil
+	case tag == blockTagAlloc:
+		if b == nil {
+			b = alloc()
+		}
+	case tag > blockTagOpenAddrArray:
+		return nil, errCorruptBlock
+	case blockTag(b) != tag:
+		b = newTaggedBlock(tag)
+	}
+	return b, d.decodeValues(b)
+}
+
+// decodeValues replaces the contents of b with the next encoded bitmap and
+// values.
+func (d *blockDecoder) decodeValues(b Sparse256Array) error {
+	var buf [32]byte
+	if _, err := io.ReadFull(d.r, buf[:]); err != nil {
+		return err
+	}
+	var bm bitmap.Bitmap256
+	for i := range bm {
+		bm[i] = binary.LittleEndian.Uint64(buf[i*8:])
+	}
+	d.values = d.values[:0]
+	if err := d.dec.Decode(&d.values); err != nil {
+		return err
+	}
+	if len(d.values) != bm.Count() {
+		return errCorruptBlock
+	}
+
+	b.Clear()
+	n := 0
+	bitmapForEach(&bm, func(i uint8) bool {
+		b.Put(i, d.values[n])
+		n++
+		return true
+	})
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// WriteTo implements io.WriterTo. The vector is streamed to w one block at a
+// time, so the full serialized form is never held in memory. The encoding is
+// the vector length as a uvarint, followed by each non-empty block in
+// ascending order as its index plus one as a uvarint and the encoded block,
+// and a terminating 0 uvarint. Empty blocks aren't written at all, so the size
+// is proportional to the number of elements, not the length.
+func (v *SparseishVector) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	var buf [binary.MaxVarintLen64]byte
+	writeUvarint := func(x uint64) error {
+		_, err := cw.Write(buf[:binary.PutUvarint(buf[:], x)])
+		return err
+	}
+
+	if err := writeUvarint(uint64(v.len)); err != nil {
+		return cw.n, err
+	}
+	enc := newBlockEncoder(cw)
+	for bi, b := range v.blocks {
+		if blockIsEmpty(b) {
+			continue
+		}
+		if err := writeUvarint(uint64(bi + 1)); err != nil {
+			return cw.n, err
+		}
+		if err := enc.encode(b); err != nil {
+			return cw.n, err
+		}
+	}
+	return cw.n, writeUvarint(0)
+}
+
+// ReadFrom implements io.ReaderFrom, replacing the contents of v with a vector
+// written by WriteTo. Each block is decoded into its original type, or one from
+// the vector's allocator if the type has no tag. Existing blocks of the right
+// type are reused, and blocks which weren't written or are replaced are freed.
+// If r is an io.ByteReader, nothing past the vector is read from it, so other
+// data can follow in the same stream. Otherwise r is buffered, and may be read
+// ahead.
+func (v *SparseishVector) ReadFrom(r io.Reader) (int64, error) {
+	d := newBlockDecoder(r)
+	length, err := readLength(d.r)
+	if err != nil {
+		return d.r.n, err
+	}
+
+	v.resize(length)
+	// Whether the block being decoded came from the allocator, rather than
+	// newTaggedBlock.
+	fromAlloc := false
+	alloc := func() Sparse256Array {
+		fromAlloc = true
+		return v.alloc()
+	}
+	next := 0
+	for {
+		bi, err := binary.ReadUvarint(d.r)
+		if err != nil {
+			return d.r.n, fmt.Errorf("vectest: reading block index: %w", unexpectedEOF(err))
+		} else if bi == 0 {
+			break
+		} else if bi > uint64(len(v.blocks)) || int(bi-1) < next {
+			// Out of range, or not ascending.
+			return d.r.n, errCorruptBlock
+		}
+		for ; next < int(bi-1); next++ {
+			v.freeBlock(next)
+		}
+		fromAlloc = false
+		old := v.blocks[next]
+		b, err := d.decode(old, alloc)
+		if fromAlloc {
+			// Only allocated in place of a nil block.
+			v.blocks[next] = b
+		} else if b != old {
+			v.adoptBlock(next, b)
+		}
+		if err != nil {
+			return d.r.n, fmt.Errorf("vectest: reading block %d: %w", next, unexpectedEOF(err))
+		}
+		next++
+	}
+	for ; next < len(v.blocks); next++ {
+		v.freeBlock(next)
+	}
+	return d.r.n, nil
+}
+
+// resize sets the length of v. Blocks dropped by shrinking are freed, and new
+// blocks are nil.
+func (v *SparseishVector) resize(length int) {
+	numBlocks := (length + blockMask) >> blockBits
+	if numBlocks <= len(v.blocks) {
+		for bi := numBlocks; bi < len(v.blocks); bi++ {
+			v.freeBlock(bi)
+		}
+		v.blocks = v.blocks[:numBlocks]
+	} else {
+		v.blocks = append(v.blocks, make([]Sparse256Array, numBlocks-len(v.blocks))...)
+	}
+	v.len = length
+}
+
+// unexpectedEOF converts io.EOF into io.ErrUnexpectedEOF, since the stream
+// should never end part way through a vector.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// ValidatingArray wraps a Sparse256Array and rejects values that the block
+// serializer can't gob-encode when they are Put, rather than when the vector is
+// written.
+type ValidatingArray struct {
+	Sparse256Array
+}
+
+// encodableTypes caches the result of checkEncodable by value type, for types
+// where the result doesn't depend on the value.
+var encodableTypes sync.Map
+
+// hasInterface reports whether values of type t can hold interface values,
+// whose dynamic types have to be checked separately for each value.
+func hasInterface(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if seen[t] {
+		return false
+	}
+	seen[t] = true
+	switch t.Kind() {
+	case reflect.Interface:
+		return true
+	case reflect.Array, reflect.Pointer, reflect.Slice:
+		return hasInterface(t.Elem(), seen)
+	case reflect.Map:
+		return hasInterface(t.Key(), seen) || hasInterface(t.Elem(), seen)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if hasInterface(t.Field(i).Type, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkEncodable returns an error if v can't be gob-encoded as an interface{}
+// value, usually because its type hasn't been registered with gob.Register.
+// Types which can hold interface values are checked on every call.
+func checkEncodable(v interface{}) error {
+	t := reflect.TypeOf(v)
+	if err, ok := encodableTypes.Load(t); ok {
+		if err != nil {
+			return err.(error)
+		}
+		return nil
+	}
+	err := gob.NewEncoder(io.Discard).Encode(&v)
+	if err != nil {
+		err = fmt.Errorf("vectest: value of type %v is not encodable: %w", t, err)
+	}
+	if !hasInterface(t, make(map[reflect.Type]bool)) {
+		if err != nil {
+			encodableTypes.Store(t, err)
+		} else {
+			encodableTypes.Store(t, nil)
+		}
+	}
+	return err
+}
+
+// PutE is Put, but returns an error instead of storing a non-encodable value.
+func (a *ValidatingArray) PutE(i uint8, v interface{}) error {
+	if v != nil {
+		if err := checkEncodable(v); err != nil {
+			return err
+		}
+	}
+	a.Sparse256Array.Put(i, v)
+	return nil
+}
+
+// Put panics if v is not encodable.
+func (a *ValidatingArray) Put(i uint8, v interface{}) {
+	if err := a.PutE(i, v); err != nil {
+		panic(err)
+	}
+}
+
+func TestSparseishVectorWriteToReadFrom(t *testing.T) {
+	const length = 5*blockSize + 17
+	testData := generateTestData(*dataSeed, 300, length)
+	for _, at := range arrayTypes {
+		v := NewSparseishVector(length, at.alloc)
+		for _, k := range testData {
+			v.Put(k, k)
+		}
+		v.Put(3, "a string")
+
+		var buf bytes.Buffer
+		n, err := v.WriteTo(&buf)
+		if err != nil {
+			t.Fatalf("%s: WriteTo error: %v", at.name, err)
+		} else if n != int64(buf.Len()) {
+			t.Errorf("%s: WriteTo returned %d != written %d", at.name, n, buf.Len())
+		}
+		encoded := buf.Bytes()
+
+		// Read into a vector of a different size, to check it's resized.
+		r := NewSparseishVector(blockSize, at.alloc)
+		n, err = r.ReadFrom(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatalf("%s: ReadFrom error: %v", at.name, err)
+		} else if n != int64(len(encoded)) {
+			t.Errorf("%s: ReadFrom returned %d != encoded %d", at.name, n, len(encoded))
+		}
+		if r.Len() != v.Len() || len(r.blocks) != len(v.blocks) {
+			t.Errorf("%s: Read length (%d, %d blocks) != expected (%d, %d blocks)",
+				at.name, r.Len(), len(r.blocks), v.Len(), len(v.blocks))
+		}
+		if r.Checksum() != v.Checksum() {
+			t.Errorf("%s: Read vector checksum %x != expected %x", at.name, r.Checksum(), v.Checksum())
+		}
+
+		for _, l := range []int{0, 1, 10, 40, len(encoded) / 2, len(encoded) - 1} {
+			r := NewSparseishVector(0, at.alloc)
+			_, err := r.ReadFrom(bytes.NewReader(encoded[:l]))
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("%s: ReadFrom truncated to %d bytes error %v, expected %v",
+					at.name, l, err, io.ErrUnexpectedEOF)
+			}
+		}
+	}
+}
+
+func TestSparseishVectorReadFromStream(t *testing.T) {
+	const length = 3*blockSize + 5
+	for _, at := range arrayTypes {
+		var vectors []*SparseishVector
+		var buf bytes.Buffer
+		var sizes []int64
+		for n, k := range generateTestData(*dataSeed, 2, length) {
+			v := NewSparseishVector(length+n*blockSize, at.alloc)
+			v.Put(k, k)
+			v.Put(n, "s")
+			size, err := v.WriteTo(&buf)
+			if err != nil {
+				t.Fatalf("%s: WriteTo error: %v", at.name, err)
+			}
+			vectors = append(vectors, v)
+			sizes = append(sizes, size)
+		}
+		buf.WriteString("trailer")
+
+		// Both bytes.Buffer and bytes.Reader are io.ByteReaders, so each
+		// ReadFrom consumes exactly one vector.
+		r := bytes.NewReader(buf.Bytes())
+		for n, v := range vectors {
+			got := newLazySparseishVector(0, at.alloc)
+			read, err := got.ReadFrom(r)
+			if err != nil {
+				t.Fatalf("%s: ReadFrom of vector %d error: %v", at.name, n, err)
+			} else if read != sizes[n] {
+				t.Errorf("%s: ReadFrom of vector %d read %d bytes != written %d", at.name, n, read, sizes[n])
+			}
+			if !got.Equal(v) {
+				t.Errorf("%s: Vector %d read back (len %d, count %d) != expected (len %d, count %d)",
+					at.name, n, got.Len(), got.Count(), v.Len(), v.Count())
+			}
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "trailer" {
+			t.Errorf("%s: Data left after the vectors %q != expected %q", at.name, rest, "trailer")
+		}
+	}
+}
+
+func TestSparseishVectorWriteToReadFromMixed(t *testing.T) {
+	const length = 6 * blockSize
+	v := NewSparseishVector(length, func() Sparse256Array { return new(BitmapArray) })
+	for bi := range v.blocks {
+		switch bi % 3 {
+		case 1:
+			v.blocks[bi] = new(SplitBinaryArray)
+		case 2:
+			v.blocks[bi] = nil
+		}
+	}
+	for _, k := range generateTestData(*dataSeed, 300, length) {
+		if v.blocks[k>>blockBits] != nil {
+			v.Put(k, k)
+		}
+	}
+	// A block type without a tag, decoded using the allocator.
+	v.blocks[3] = &ValidatingArray{&MapArray{m: make(map[uint8]interface{})}}
+	v.Put(3*blockSize+5, 5)
+
+	var buf bytes.Buffer
+	if _, err := v.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo error: %v", err)
+	}
+	// Read into a vector with existing blocks of the wrong types.
+	r := NewSparseishVector(length, func() Sparse256Array { return new(OpenAddrArray) })
+	if _, err := r.ReadFrom(&buf); err != nil {
+		t.Fatalf("ReadFrom error: %v", err)
+	}
+	if r.Checksum() != v.Checksum() {
+		t.Errorf("Read vector checksum %x != expected %x", r.Checksum(), v.Checksum())
+	}
+	for bi := range v.blocks {
+		expected := reflect.TypeOf(v.blocks[bi])
+		if bi == 3 {
+			expected = reflect.TypeOf(&OpenAddrArray{})
+		}
+		if got := reflect.TypeOf(r.blocks[bi]); got != expected {
+			t.Errorf("Block %d type %v != expected %v", bi, got, expected)
+		}
+	}
+
+	for _, bad := range [][]byte{
+		// Bad tag.
+		{1, 1, blockTagOpenAddrArray + 1},
+		// Block index out of range.
+		{1, 2},
+		// Block indices not ascending, in a vector of length 512.
+		{0x80, 0x04, 2, blockTagNil, 1},
+		// Length of 1<<63+5, which overflows an int.
+		{0x85, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01, 0},
+		// Length of 1<<40, over maxReadLength.
+		{0x80, 0x80, 0x80, 0x80, 0x80, 0x20, 0},
+	} {
+		if _, err := r.ReadFrom(bytes.NewReader(bad)); !errors.Is(err, errCorruptBlock) {
+			t.Errorf("ReadFrom(%v) error %v, expected %v", bad, err, errCorruptBlock)
+		}
+	}
+}
+
+func TestSparseishVectorWriteToSkipsEmptyBlocks(t *testing.T) {
+	for _, at := range arrayTypes {
+		var sizes []int
+		for _, numBlocks := range []int{10, 10000} {
+			v := NewSparseishVector(numBlocks*blockSize, at.alloc)
+			v.Put(3, 3)
+			v.Put(5*blockSize+1, "a")
+			v.Put(5*blockSize+200, "b")
+			// Allocated, but emptied.
+			v.Put(7*blockSize, 7)
+			v.Put(7*blockSize, nil)
+
+			var buf bytes.Buffer
+			if _, err := v.WriteTo(&buf); err != nil {
+				t.Fatalf("%s: WriteTo error: %v", at.name, err)
+			}
+			sizes = append(sizes, buf.Len())
+
+			r := newLazySparseishVector(0, at.alloc)
+			if _, err := r.ReadFrom(&buf); err != nil {
+				t.Fatalf("%s: ReadFrom error: %v", at.name, err)
+			}
+			if !r.Equal(v) {
+				t.Errorf("%s: Read vector (len %d, count %d) != expected (len %d, count %d)",
+					at.name, r.Len(), r.Count(), v.Len(), v.Count())
+			}
+			for bi, b := range r.blocks {
+				if (b == nil) != (bi != 0 && bi != 5) {
+					t.Errorf("%s: Read block %d allocated %v", at.name, bi, b != nil)
+				}
+			}
+		}
+		// Only the length's uvarint grows with the number of empty blocks.
+		if sizes[1]-sizes[0] > 2 {
+			t.Errorf("%s: Encoded size grew from %d to %d bytes with empty blocks", at.name, sizes[0], sizes[1])
+		}
+	}
+}
+
+type unregisteredValue struct {
+	A int
+}
+
+type registeredValue struct {
+	B string
+}
+
+// registeredHolder is registered, but whether a value is encodable depends on
+// the dynamic type of V.
+type registeredHolder struct {
+	V interface{}
+}
+
+func init() {
+	gob.Register(registeredValue{})
+	gob.Register(registeredHolder{})
+}
+
+func TestValidatingArray(t *testing.T) {
+	for _, at := range arrayTypes {
+		a := &ValidatingArray{at.alloc()}
+		if err := a.PutE(1, unregisteredValue{1}); err == nil {
+			t.Errorf("%s: PutE of unregistered type succeeded", at.name)
+		}
+		if a.Get(1) != nil {
+			t.Errorf("%s: Rejected value stored", at.name)
+		}
+		if err := a.PutE(2, registeredValue{"b"}); err != nil {
+			t.Errorf("%s: PutE of registered type error: %v", at.name, err)
+		}
+		if err := a.PutE(3, 3); err != nil {
+			t.Errorf("%s: PutE of int error: %v", at.name, err)
+		}
+		if err := a.PutE(3, nil); err != nil {
+			t.Errorf("%s: PutE of nil error: %v", at.name, err)
+		}
+		if a.Get(2) != (registeredValue{"b"}) || a.Get(3) != nil {
+			t.Errorf("%s: Get (%v, %v) != expected ({b}, nil)", at.name, a.Get(2), a.Get(3))
+		}
+		// A good value of a type doesn't make later values of it acceptable.
+		if err := a.PutE(5, registeredHolder{1}); err != nil {
+			t.Errorf("%s: PutE of registered holder error: %v", at.name, err)
+		}
+		if err := a.PutE(6, registeredHolder{unregisteredValue{6}}); err == nil {
+			t.Errorf("%s: PutE of registered holder of unregistered type succeeded", at.name)
+		}
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: Put of unregistered type didn't panic", at.name)
+				}
+			}()
+			a.Put(4, unregisteredValue{4})
+		}()
+
+		v := NewSparseishVector(blockSize, func() Sparse256Array {
+			return &ValidatingArray{at.alloc()}
+		})
+		v.Put(5, registeredValue{"c"})
+		var buf bytes.Buffer
+		if _, err := v.WriteTo(&buf); err != nil {
+			t.Errorf("%s: WriteTo error: %v", at.name, err)
+		}
+	}
+}
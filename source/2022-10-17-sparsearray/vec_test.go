@@ -1,10 +1,21 @@
 package vectest
 
 import (
+	"bytes"
+	"encoding/binary"
+	"flag"
 	"fmt"
+	"hash/fnv"
+	"iter"
 	"log"
+	"math"
+	"math/bits"
 	"math/rand"
+	"reflect"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"unsafe"
 
@@ -15,367 +26,4262 @@ type Sparse256Array interface {
 	Clear()
 	Put(i uint8, v interface{})
 	Get(i uint8) interface{}
+	// Len returns the number of present elements.
+	Len() int
+	// Range calls f for each present element in index order, stopping if f
+	// returns false.
+	Range(f func(i uint8, v interface{}) bool)
+	// Kind returns the name of the backing representation, such as
+	// "BitmapArray". Wrappers report the kind of the array they wrap.
+	Kind() string
 }
 
+const (
+	// Blocks are addressed by the low byte of the index, so the block size is
+	// fixed at 256. Keeping these as constants lets Get/Put use a shift and
+	// mask instead of a (signed) division.
+	blockBits = 8
+	blockSize = 1 << blockBits
+	blockMask = blockSize - 1
+)
+
 type SparseishVector struct {
+	// A nil block has no elements, and is allocated on the first Put.
 	blocks []Sparse256Array
 	len    int
+	alloc  func() Sparse256Array
+	// If set, free is called with each allocated block the vector drops, and
+	// adopt with each block it takes on other than from alloc, such as a
+	// clone or a decoded block of a different type. BlockCounter uses these
+	// to count live blocks.
+	free  func(b Sparse256Array)
+	adopt func(b Sparse256Array)
+	// Set by Freeze, after which no blocks are allocated.
+	frozen bool
 }
 
 func NewSparseishVector(length int, allocArray func() Sparse256Array) *SparseishVector {
-	v := &SparseishVector{
-		blocks: make([]Sparse256Array, (length+255)/256),
-		len:    length,
-	}
+	v := newLazySparseishVector(length, allocArray)
 	for i := range v.blocks {
 		v.blocks[i] = allocArray()
 	}
 	return v
 }
 
+// newLazySparseishVector returns a vector with every block unallocated.
+func newLazySparseishVector(length int, allocArray func() Sparse256Array) *SparseishVector {
+	return &SparseishVector{
+		blocks: make([]Sparse256Array, (length+blockMask)>>blockBits),
+		len:    length,
+		alloc:  allocArray,
+	}
+}
+
 func (v *SparseishVector) Len() int {
 	return v.len
 }
 
+// newLazyLike returns a vector of the given length with every block
+// unallocated, and v's allocator and hooks.
+func (v *SparseishVector) newLazyLike(length int) *SparseishVector {
+	r := newLazySparseishVector(length, v.alloc)
+	r.free, r.adopt = v.free, v.adopt
+	return r
+}
+
+// Cap returns the number of indices the vector can address without growing,
+// which is Len rounded up to a whole number of blocks. Put and Get work for
+// indices in [Len, Cap).
+func (v *SparseishVector) Cap() int {
+	return len(v.blocks) << blockBits
+}
+
+// Grow extends the length of the vector by n. New blocks are left unallocated
+// until first Put, and the blocks slice grows geometrically, so repeated small
+// Grows are amortized.
+func (v *SparseishVector) Grow(n int) {
+	v.len += n
+	numBlocks := (v.len + blockMask) >> blockBits
+	if numBlocks > len(v.blocks) {
+		v.blocks = append(v.blocks, make([]Sparse256Array, numBlocks-len(v.blocks))...)
+	}
+}
+
 func (v *SparseishVector) Clear() {
+	if v.frozen {
+		panic("vectest: Clear on a frozen SparseishVector")
+	}
 	for _, b := range v.blocks {
-		b.Clear()
+		if b != nil {
+			b.Clear()
+		}
 	}
 }
 
-func (v *SparseishVector) Put(i int, val interface{}) {
-	v.blocks[i/256].Put(uint8(i), val)
+// ClearRange clears the elements with indices in [lo, hi). Blocks entirely
+// inside the range are cleared in one go, and the partial blocks at either end
+// have their elements deleted individually.
+func (v *SparseishVector) ClearRange(lo, hi int) {
+	for lo < hi {
+		b := v.blocks[lo>>blockBits]
+		end := (lo | blockMask) + 1
+		if end > hi {
+			end = hi
+		}
+		if b == nil {
+			// Already empty.
+		} else if lo&blockMask == 0 && end-lo == blockSize {
+			b.Clear()
+		} else {
+			for i := lo; i < end; i++ {
+				if b.Get(uint8(i&blockMask)) != nil {
+					b.Put(uint8(i&blockMask), nil)
+				}
+			}
+		}
+		lo = end
+	}
 }
 
-func (v *SparseishVector) Get(i int) interface{} {
-	return v.blocks[i/256].Get(uint8(i))
+// FillRange sets every index in [lo, hi) to val. BitmapArray blocks are filled
+// in bulk with BitmapArray.FillRange, and other block types fall back to Put.
+// A nil val clears the range.
+func (v *SparseishVector) FillRange(lo, hi int, val interface{}) {
+	if val == nil {
+		v.ClearRange(lo, hi)
+		return
+	}
+	for lo < hi {
+		bi := lo >> blockBits
+		end := (lo | blockMask) + 1
+		if end > hi {
+			end = hi
+		}
+		b := v.blocks[bi]
+		if b == nil {
+			b = v.allocBlock(bi)
+		}
+		if ba, ok := b.(*BitmapArray); ok {
+			ba.FillRange(lo&blockMask, lo&blockMask+end-lo, val)
+		} else {
+			for i := lo; i < end; i++ {
+				b.Put(uint8(i&blockMask), val)
+			}
+		}
+		lo = end
+	}
 }
 
-type MapArray struct {
-	m map[uint8]interface{}
+func (v *SparseishVector) Put(i int, val interface{}) {
+	b := v.blocks[i>>blockBits]
+	if b == nil {
+		if val == nil && !v.frozen {
+			return
+		}
+		b = v.allocBlock(i >> blockBits)
+	}
+	b.Put(uint8(i&blockMask), val)
 }
 
-func (a *MapArray) Clear() {
-	a.m = make(map[uint8]interface{})
+// allocBlock allocates the block at bi, which must be nil. It panics if the
+// vector is frozen, so that Put on a frozen vector panics for unallocated
+// blocks as well as FrozenArray ones.
+func (v *SparseishVector) allocBlock(bi int) Sparse256Array {
+	if v.frozen {
+		panic("vectest: modifying a frozen SparseishVector")
+	}
+	b := v.alloc()
+	v.blocks[bi] = b
+	return b
 }
 
-func (a *MapArray) Put(i uint8, v interface{}) {
-	if v == nil {
-		delete(a.m, i)
-	} else {
-		a.m[i] = v
+func (v *SparseishVector) Get(i int) interface{} {
+	b := v.blocks[i>>blockBits]
+	if b == nil {
+		return nil
 	}
+	return b.Get(uint8(i & blockMask))
 }
 
-func (a *MapArray) Get(i uint8) interface{} {
-	return a.m[i]
+// GetOrCompute returns the value at i if present. Otherwise it calls load,
+// stores the result at i, and returns it. The block is looked up once for both
+// the Get and the Put. If load returns nil, nothing is stored.
+func (v *SparseishVector) GetOrCompute(i int, load func() interface{}) interface{} {
+	bi, bIndex := i>>blockBits, uint8(i&blockMask)
+	b := v.blocks[bi]
+	if b != nil {
+		if val := b.Get(bIndex); val != nil {
+			return val
+		}
+	}
+	val := load()
+	if val == nil {
+		return nil
+	} else if b == nil {
+		b = v.allocBlock(bi)
+	}
+	b.Put(bIndex, val)
+	return val
 }
 
-type binaryArrayItem struct {
-	index uint8
-	v     interface{}
+// At returns the value at i, and whether it is present. Unlike Get, it doesn't
+// panic if i is out of range. Since Put with a nil value deletes, a present
+// value is never nil.
+func (v *SparseishVector) At(i int) (interface{}, bool) {
+	if i < 0 || i >= v.len {
+		return nil, false
+	}
+	val := v.Get(i)
+	return val, val != nil
 }
 
-type BinaryArray struct {
-	items []binaryArrayItem
+// ContainsAll reports whether each of indices is present. Probes are grouped
+// by block with a counting sort, and each block's presence bitmap is fetched
+// once, rather than looking up the block and searching it for every index.
+// Like At, out-of-range indices are reported as absent.
+func (v *SparseishVector) ContainsAll(indices []int) []bool {
+	found := make([]bool, len(indices))
+	// starts[bi+1] counts the probes in block bi, then becomes the offset
+	// of block bi+1's probes in order.
+	starts := make([]int, len(v.blocks)+1)
+	for _, i := range indices {
+		if i >= 0 && i < v.len {
+			starts[i>>blockBits+1]++
+		}
+	}
+	for bi := 1; bi < len(starts); bi++ {
+		starts[bi] += starts[bi-1]
+	}
+	order := make([]int, starts[len(v.blocks)])
+	next := append([]int(nil), starts[:len(v.blocks)]...)
+	for n, i := range indices {
+		if i >= 0 && i < v.len {
+			order[next[i>>blockBits]] = n
+			next[i>>blockBits]++
+		}
+	}
+
+	for bi, b := range v.blocks {
+		probes := order[starts[bi]:starts[bi+1]]
+		if len(probes) == 0 || b == nil {
+			continue
+		}
+		bm := blockBitmap(b)
+		for _, n := range probes {
+			found[n] = bm.Get(uint8(indices[n] & blockMask))
+		}
+	}
+	return found
 }
 
-func (a *BinaryArray) Clear() {
-	a.items = nil
+func (v *SparseishVector) Range(f func(i int, v interface{}) bool) {
+	for bi, b := range v.blocks {
+		if b == nil {
+			continue
+		}
+		base := bi << blockBits
+		cont := true
+		b.Range(func(i uint8, val interface{}) bool {
+			cont = f(base+int(i), val)
+			return cont
+		})
+		if !cont {
+			return
+		}
+	}
 }
 
-func (a *BinaryArray) Put(i uint8, v interface{}) {
-	index := sort.Search(len(a.items), func(n int) bool {
-		return a.items[n].index >= i
-	})
-	if index < len(a.items) && a.items[index].index == i {
-		if v == nil {
-			copy(a.items[index:], a.items[index+1:])
-			a.items = a.items[:len(a.items)-1]
+// RangeFrom is Range, starting at the first present index >= start. It starts
+// directly at the block containing start. If that block is a BitmapArray, the
+// elements before start are skipped using the bitmap, rather than Range.
+func (v *SparseishVector) RangeFrom(start int, f func(i int, v interface{}) bool) {
+	if start < 0 {
+		start = 0
+	}
+	for bi := start >> blockBits; bi < len(v.blocks); bi++ {
+		b := v.blocks[bi]
+		if b == nil {
+			continue
+		}
+		base := bi << blockBits
+		lo := 0
+		if base < start {
+			lo = start - base
+		}
+		cont := true
+		if ba, ok := b.(*BitmapArray); ok && lo > 0 {
+			i, ok := uint8(lo), ba.bm.Get(uint8(lo))
+			if !ok {
+				i, ok = BitmapNextSet(&ba.bm, uint8(lo))
+			}
+			for n := ba.bm.CountLess(i); ok && cont; n++ {
+				cont = f(base+int(i), ba.values[n])
+				i, ok = BitmapNextSet(&ba.bm, i)
+			}
 		} else {
-			a.items[index].v = v
+			b.Range(func(i uint8, val interface{}) bool {
+				if int(i) >= lo {
+					cont = f(base+int(i), val)
+				}
+				return cont
+			})
+		}
+		if !cont {
+			return
 		}
-	} else {
-		a.items = append(a.items, binaryArrayItem{})
-		copy(a.items[index+1:], a.items[index:])
-		a.items[index].index = i
-		a.items[index].v = v
 	}
 }
 
-func (a *BinaryArray) Get(i uint8) interface{} {
-	index := sort.Search(len(a.items), func(n int) bool {
-		return a.items[n].index >= i
+// All returns an iterator over the present elements, for use with range.
+func (v *SparseishVector) All() iter.Seq2[int, interface{}] {
+	return v.Range
+}
+
+// Map replaces every present element with the result of f. If f returns nil,
+// the element is deleted.
+func (v *SparseishVector) Map(f func(i int, v interface{}) interface{}) {
+	var ops []Op
+	for bi, b := range v.blocks {
+		if b == nil {
+			continue
+		}
+		base := bi << blockBits
+		// Blocks can't be modified during Range, so collect the results first.
+		ops = ops[:0]
+		b.Range(func(i uint8, val interface{}) bool {
+			ops = append(ops, Op{Index: i, Value: f(base+int(i), val)})
+			return true
+		})
+		for _, op := range ops {
+			b.Put(op.Index, op.Value)
+		}
+	}
+}
+
+// MapCopy returns a new vector, using the same allocator as v, containing the
+// result of f for every present element of v. Elements for which f returns nil
+// are left out, and blocks are only allocated in the result if they have an
+// element.
+func (v *SparseishVector) MapCopy(f func(i int, v interface{}) interface{}) *SparseishVector {
+	r := v.newLazyLike(v.len)
+	v.Range(func(i int, val interface{}) bool {
+		r.Put(i, f(i, val))
+		return true
 	})
-	if index < len(a.items) && a.items[index].index == i {
-		return a.items[index].v
+	return r
+}
+
+// Copy returns an independent copy of v. Blocks are copied with their Clone
+// method where they have one, or otherwise into a block from v's allocator.
+// Values themselves are shared, not copied.
+func (v *SparseishVector) Copy() *SparseishVector {
+	r := v.newLazyLike(v.len)
+	for bi, b := range v.blocks {
+		if c, ok := b.(interface{ Clone() Sparse256Array }); ok {
+			r.adoptBlock(bi, c.Clone())
+		} else if b != nil {
+			nb := v.alloc()
+			b.Range(func(i uint8, val interface{}) bool {
+				nb.Put(i, val)
+				return true
+			})
+			r.blocks[bi] = nb
+		}
 	}
-	return nil
+	return r
 }
 
-type SplitBinaryArray struct {
-	indexes []uint8
-	values  []interface{}
+// Filter returns a new vector, using the same allocator as v, containing the
+// elements of v for which pred returns true, at the same indices. Blocks are
+// only allocated in the result if they have a matching element.
+func (v *SparseishVector) Filter(pred func(i int, v interface{}) bool) *SparseishVector {
+	r := v.newLazyLike(v.len)
+	v.Range(func(i int, val interface{}) bool {
+		if pred(i, val) {
+			r.Put(i, val)
+		}
+		return true
+	})
+	return r
 }
 
-func (a *SplitBinaryArray) Clear() {
-	a.indexes, a.values = nil, nil
+// A Pair is an element of a vector, for BuildFromPairs.
+type Pair struct {
+	I int
+	V interface{}
 }
 
-func (a *SplitBinaryArray) Put(i uint8, v interface{}) {
-	index := sort.Search(len(a.indexes), func(n int) bool {
-		return a.indexes[n] >= i
+// BuildFromPairs returns a vector of the given length containing pairs, which
+// may be unsorted and contain duplicate indices. The last pair for an index
+// wins. Pairs are sorted so that each block is loaded in index order, with
+// its storage reserved up front, which avoids shifting elements within blocks.
+// Blocks without any pairs are left unallocated.
+func BuildFromPairs(length int, pairs []Pair, allocArray func() Sparse256Array) *SparseishVector {
+	sorted := append([]Pair(nil), pairs...)
+	// A stable sort keeps duplicates in their original order.
+	sort.SliceStable(sorted, func(a, b int) bool {
+		return sorted[a].I < sorted[b].I
 	})
-	if index < len(a.indexes) && a.indexes[index] == i {
-		if v == nil {
-			copy(a.indexes[index:], a.indexes[index+1:])
-			a.indexes = a.indexes[:len(a.indexes)-1]
 
-			copy(a.values[index:], a.values[index+1:])
-			a.values = a.values[:len(a.values)-1]
-		} else {
-			a.values[index] = v
+	v := newLazySparseishVector(length, allocArray)
+	for start := 0; start < len(sorted); {
+		bi := sorted[start].I >> blockBits
+		end := start
+		for end < len(sorted) && sorted[end].I>>blockBits == bi {
+			end++
 		}
-	} else {
-		a.indexes = append(a.indexes, 0)
-		copy(a.indexes[index+1:], a.indexes[index:])
-		a.indexes[index] = i
+		b := allocArray()
+		if r, ok := b.(interface{ Reserve(n int) }); ok {
+			r.Reserve(end - start)
+		}
+		for n := start; n < end; n++ {
+			if n+1 < end && sorted[n+1].I == sorted[n].I {
+				continue
+			}
+			b.Put(uint8(sorted[n].I&blockMask), sorted[n].V)
+		}
+		v.blocks[bi] = b
+		start = end
+	}
+	return v
+}
 
-		a.values = append(a.values, nil)
-		copy(a.values[index+1:], a.values[index:])
-		a.values[index] = v
+// Concat returns a new vector containing each of vectors in turn, with the
+// indices of each shifted by the total length of the vectors before it.
+// Elements are re-indexed one at a time, since vector lengths needn't be a
+// multiple of the block size. Blocks are allocated lazily with the allocator
+// of the first vector. Concat of no vectors returns nil.
+func Concat(vectors ...*SparseishVector) *SparseishVector {
+	if len(vectors) == 0 {
+		return nil
+	}
+	length := 0
+	for _, v := range vectors {
+		length += v.len
 	}
+	r := vectors[0].newLazyLike(length)
+	offset := 0
+	for _, v := range vectors {
+		v.Range(func(i int, val interface{}) bool {
+			r.Put(offset+i, val)
+			return true
+		})
+		offset += v.len
+	}
+	return r
 }
 
-func (a *SplitBinaryArray) Get(i uint8) interface{} {
-	index := sort.Search(len(a.indexes), func(n int) bool {
-		return a.indexes[n] >= i
-	})
-	if index < len(a.indexes) && a.indexes[index] == i {
-		return a.values[index]
+// Slice returns a copy of the elements with indices in [lo, hi), re-based to
+// start at 0. It is a copy rather than a view, so later changes to either
+// vector don't affect the other. Blocks are allocated lazily with the
+// allocator of v. Like slicing in Go, it panics if the range is invalid.
+func (v *SparseishVector) Slice(lo, hi int) *SparseishVector {
+	if lo < 0 || hi > v.len || lo > hi {
+		panic(fmt.Sprintf("vectest: Slice [%d:%d] out of range with length %d", lo, hi, v.len))
 	}
-	return nil
+	r := v.newLazyLike(hi - lo)
+	for bi := lo >> blockBits; bi<<blockBits < hi; bi++ {
+		b := v.blocks[bi]
+		if b == nil {
+			continue
+		}
+		base := bi << blockBits
+		b.Range(func(i uint8, val interface{}) bool {
+			j := base + int(i)
+			if j >= hi {
+				return false
+			} else if j >= lo {
+				r.Put(j-lo, val)
+			}
+			return true
+		})
+	}
+	return r
 }
 
-type BitmapArray struct {
-	bm     bitmap.Bitmap256
-	values []interface{}
+// ClearRetain clears the vector, keeping each block's allocated storage for
+// reuse where the block supports it.
+func (v *SparseishVector) ClearRetain() {
+	for _, b := range v.blocks {
+		if r, ok := b.(interface{ ClearRetain() }); ok {
+			r.ClearRetain()
+		} else if b != nil {
+			b.Clear()
+		}
+	}
 }
 
-func (a *BitmapArray) Clear() {
-	a.bm = bitmap.Bitmap256{}
-	a.values = nil
+// Reserve pre-grows each block to hold perBlock elements, for blocks which
+// support it, to avoid incremental reallocation during a bulk load.
+func (v *SparseishVector) Reserve(perBlock int) {
+	for _, b := range v.blocks {
+		if r, ok := b.(interface{ Reserve(n int) }); ok {
+			r.Reserve(perBlock)
+		}
+	}
 }
 
-func (a *BitmapArray) Put(i uint8, v interface{}) {
-	index := a.bm.CountLess(i)
-	if index < len(a.values) && a.bm.Get(i) {
-		if v == nil {
-			a.bm.Clear(i)
-			copy(a.values[index:], a.values[index+1:])
-			a.values = a.values[:len(a.values)-1]
-		} else {
-			a.values[index] = v
+// IsEmpty returns true if no elements are present, stopping at the first
+// non-empty block.
+func (v *SparseishVector) IsEmpty() bool {
+	for _, b := range v.blocks {
+		if !blockIsEmpty(b) {
+			return false
 		}
-	} else if v != nil {
-		a.bm.Set(i)
-		a.values = append(a.values, nil)
-		copy(a.values[index+1:], a.values[index:])
-		a.values[index] = v
 	}
+	return true
 }
 
-func (a *BitmapArray) Get(i uint8) interface{} {
-	index := a.bm.CountLess(i)
-	if index < len(a.values) && a.bm.Get(i) {
-		return a.values[index]
+// Sweep frees every allocated block which has no elements, setting it back to
+// unallocated, and returns the number of blocks freed. The length is
+// unchanged.
+func (v *SparseishVector) Sweep() int {
+	freed := 0
+	for bi, b := range v.blocks {
+		if b != nil && blockIsEmpty(b) {
+			v.freeBlock(bi)
+			freed++
+		}
 	}
-	return nil
+	return freed
 }
 
-type arrayType struct {
-	name  string
-	alloc func() Sparse256Array
+// freeBlock drops the block at bi, leaving it unallocated.
+func (v *SparseishVector) freeBlock(bi int) {
+	if v.free != nil && v.blocks[bi] != nil {
+		v.free(v.blocks[bi])
+	}
+	v.blocks[bi] = nil
 }
 
-var arrayTypes = []arrayType{
-	{"MapArray", func() Sparse256Array {
-		return &MapArray{m: make(map[uint8]interface{})}
-	}},
-	{"BinaryArray", func() Sparse256Array {
-		return &BinaryArray{}
-	}},
-	{"SplitBinaryArray", func() Sparse256Array {
-		return &SplitBinaryArray{}
-	}},
-	{"BitmapArray", func() Sparse256Array {
-		return &BitmapArray{}
-	}},
+// adoptBlock replaces the block at bi with b, which didn't come from alloc,
+// freeing the old block.
+func (v *SparseishVector) adoptBlock(bi int, b Sparse256Array) {
+	v.freeBlock(bi)
+	if v.adopt != nil && b != nil {
+		v.adopt(b)
+	}
+	v.blocks[bi] = b
 }
 
-func init() {
-	log.Printf("sizeof(MapArray): %d", unsafe.Sizeof(MapArray{}))
-	log.Printf("sizeof(BinaryArray): %d", unsafe.Sizeof(BinaryArray{}))
-	log.Printf("sizeof(binaryArrayItem): %d", unsafe.Sizeof(binaryArrayItem{}))
-	log.Printf("sizeof(SplitBinaryArray): %d", unsafe.Sizeof(SplitBinaryArray{}))
-	log.Printf("sizeof(BitmapArray): %d", unsafe.Sizeof(BitmapArray{}))
+// Count returns the number of elements present in the vector.
+func (v *SparseishVector) Count() int {
+	n := 0
+	for _, b := range v.blocks {
+		if b != nil {
+			n += b.Len()
+		}
+	}
+	return n
 }
 
-func generateTestData(size, maxInt int) []int {
-	d := make([]int, size)
-	for i := range d {
-		d[i] = rand.Intn(maxInt)
+// Reduce folds f over the present elements of v in index order, starting with
+// init, and returns the result.
+func Reduce[A any](v *SparseishVector, init A, f func(acc A, i int, val interface{}) A) A {
+	acc := init
+	for bi, b := range v.blocks {
+		if b == nil {
+			continue
+		}
+		base := bi << blockBits
+		b.Range(func(i uint8, val interface{}) bool {
+			acc = f(acc, base+int(i), val)
+			return true
+		})
 	}
-	return d
+	return acc
 }
 
-const (
-	ArraySize = 50 * 1000 * 1000
-)
+func blockIsEmpty(b Sparse256Array) bool {
+	if b == nil {
+		return true
+	} else if ba, ok := b.(*BitmapArray); ok {
+		return ba.bm == bitmap.Bitmap256{}
+	}
+	empty := true
+	b.Range(func(uint8, interface{}) bool {
+		empty = false
+		return false
+	})
+	return empty
+}
 
-var (
-	FillPercentiles = []int{1, 5, 10, 25, 50, 75, 90, 95, 99}
-	staticTestData  = generateTestData(ArraySize, ArraySize)
-)
+// blockBitmap returns the set of indices present in b.
+func blockBitmap(b Sparse256Array) bitmap.Bitmap256 {
+	var bm bitmap.Bitmap256
+	if b == nil {
+		return bm
+	} else if ba, ok := b.(*BitmapArray); ok {
+		return ba.bm
+	}
+	b.Range(func(i uint8, _ interface{}) bool {
+		bm.Set(i)
+		return true
+	})
+	return bm
+}
 
-func BenchmarkArrayPut(b *testing.B) {
-	for _, p := range FillPercentiles {
-		fillItems := (ArraySize * p) / 100
-		testData := staticTestData[:fillItems]
-		for _, t := range arrayTypes {
-			testName := fmt.Sprintf("%s/%d%%", t.name, p)
-			v := NewSparseishVector(ArraySize, t.alloc)
-			b.Run(testName, func(b *testing.B) {
-				for i := 0; i < b.N; i++ {
-					if i > 0 && i%fillItems == 0 {
-						b.StopTimer()
-						v.Clear()
-						b.StartTimer()
-					}
-					k := testData[i%fillItems]
-					v.Put(k, k)
-				}
-			})
+// CompareAndSwap sets the element at i in block b to newV, only if its current
+// value equals oldV, and reports whether it did. A nil oldV matches an absent
+// element, and a nil newV deletes. Values are compared with eq, or with
+// valuesEqual if eq is nil. The block isn't locked, so callers sharing b
+// between goroutines must provide their own synchronisation.
+func CompareAndSwap(b Sparse256Array, i uint8, oldV, newV interface{}, eq func(x, y interface{}) bool) bool {
+	if eq == nil {
+		eq = valuesEqual
+	}
+	cur := b.Get(i)
+	if cur == nil || oldV == nil {
+		if cur != oldV {
+			return false
 		}
+	} else if !eq(cur, oldV) {
+		return false
 	}
+	b.Put(i, newV)
+	return true
 }
 
-func BenchmarkArrayGet(b *testing.B) {
-	for _, p := range FillPercentiles {
-		fillItems := (ArraySize * p) / 100
-		testData := staticTestData[:fillItems]
-		var sortedTestData []int
+// FirstAbsent returns the smallest index not present in block b, or false if
+// b is full.
+func FirstAbsent(b Sparse256Array) (uint8, bool) {
+	free := BitmapInvert(blockBitmap(b))
+	if free.Get(0) {
+		return 0, true
+	}
+	return BitmapNextSet(&free, 0)
+}
 
-		for _, t := range arrayTypes {
-			testName := fmt.Sprintf("%s/%d%%", t.name, p)
-			v := NewSparseishVector(ArraySize, t.alloc)
-			initVec := true
-			b.Run(testName, func(b *testing.B) {
-				if sortedTestData == nil {
-					// Sorting the elements to be inserted is much quicker than
-					// doing it randomly, due to improved cache locality.
-					sortedTestData = append([]int(nil), testData...)
-					sort.Sort(sort.IntSlice(sortedTestData))
-				}
-				if initVec {
+// Union returns a new BitmapArray holding every element of a and b. For
+// indices present in both, the value is combine(av, bv), and the element is
+// left out if that is nil. Neither a nor b is modified.
+func Union(a, b Sparse256Array, combine func(av, bv interface{}) interface{}) Sparse256Array {
+	aBm, bBm := blockBitmap(a), blockBitmap(b)
+	both := BitmapAnd(aBm, bBm)
+	all := BitmapOr(aBm, bBm)
+	u := &BitmapArray{}
+	u.Reserve(all.Count())
+	// Elements are added in index order, so each Put appends.
+	bitmapForEach(&all, func(i uint8) bool {
+		if both.Get(i) {
+			u.Put(i, combine(a.Get(i), b.Get(i)))
+		} else if aBm.Get(i) {
+			u.Put(i, a.Get(i))
+		} else {
+			u.Put(i, b.Get(i))
+		}
+		return true
+	})
+	return u
+}
+
+// ForEachBlockBitmap calls f with a copy of the presence bitmap of each
+// allocated block. For BitmapArray blocks this is the block's own bitmap, and
+// for other block types it is derived using Range.
+func (v *SparseishVector) ForEachBlockBitmap(f func(blockIndex int, bm bitmap.Bitmap256)) {
+	for bi, b := range v.blocks {
+		if b != nil {
+			f(bi, blockBitmap(b))
+		}
+	}
+}
+
+// MergeN calls f for each index present in any of vectors, in ascending order,
+// with the value from each vector (nil where absent). The values slice is
+// reused between calls.
+func MergeN(vectors []*SparseishVector, f func(i int, values []interface{})) {
+	numBlocks := 0
+	for _, v := range vectors {
+		if len(v.blocks) > numBlocks {
+			numBlocks = len(v.blocks)
+		}
+	}
+
+	values := make([]interface{}, len(vectors))
+	for bi := 0; bi < numBlocks; bi++ {
+		var candidates bitmap.Bitmap256
+		for _, v := range vectors {
+			if bi < len(v.blocks) {
+				BitmapOrWith(&candidates, blockBitmap(v.blocks[bi]))
+			}
+		}
+		bitmapForEach(&candidates, func(i uint8) bool {
+			for n, v := range vectors {
+				values[n] = nil
+				if bi < len(v.blocks) && v.blocks[bi] != nil {
+					values[n] = v.blocks[bi].Get(i)
+				}
+			}
+			f(bi<<blockBits+int(i), values)
+			return true
+		})
+	}
+}
+
+// IterateDifference calls f, in ascending order, for each element present in a
+// but not in b. Each block's candidates are found with a single AndNot of the
+// two blocks' bitmaps.
+func IterateDifference(a, b *SparseishVector, f func(i int, v interface{})) {
+	for bi, ab := range a.blocks {
+		if ab == nil {
+			continue
+		}
+		base := bi << blockBits
+		if bi >= len(b.blocks) || b.blocks[bi] == nil {
+			ab.Range(func(i uint8, val interface{}) bool {
+				f(base+int(i), val)
+				return true
+			})
+			continue
+		}
+		diff := BitmapAndNot(blockBitmap(ab), blockBitmap(b.blocks[bi]))
+		bitmapForEach(&diff, func(i uint8) bool {
+			f(base+int(i), ab.Get(i))
+			return true
+		})
+	}
+}
+
+// Sample calls f for a random sample of the present elements, in index order,
+// selecting each element with probability rate. Gaps between samples are drawn
+// from a geometric distribution using rng, so whole blocks can be skipped
+// using their element counts.
+func (v *SparseishVector) Sample(rate float64, rng *rand.Rand, f func(i int, v interface{})) {
+	if rate <= 0 {
+		return
+	}
+	nextSkip := func() int {
+		if rate >= 1 {
+			return 0
+		}
+		return int(math.Log(1-rng.Float64()) / math.Log(1-rate))
+	}
+
+	skip := nextSkip()
+	for bi, b := range v.blocks {
+		if b == nil {
+			continue
+		}
+		n := b.Len()
+		if skip >= n {
+			skip -= n
+			continue
+		}
+		b.Range(func(i uint8, val interface{}) bool {
+			if skip > 0 {
+				skip--
+				return true
+			}
+			f(bi<<blockBits+int(i), val)
+			skip = nextSkip()
+			return true
+		})
+	}
+}
+
+// Equal returns true if v and other have the same length and the same present
+// (index, value) pairs, regardless of block types. Presence bitmaps are compared
+// first, using the BitmapArray fast path in blockBitmap, before any values.
+// Values are compared with valuesEqual.
+func (v *SparseishVector) Equal(other *SparseishVector) bool {
+	return v.EqualFunc(other, nil)
+}
+
+// EqualFunc is Equal, but compares values with eq, or with valuesEqual if eq is
+// nil.
+func (v *SparseishVector) EqualFunc(other *SparseishVector, eq func(a, b interface{}) bool) bool {
+	if eq == nil {
+		eq = valuesEqual
+	}
+	if v.len != other.len || len(v.blocks) != len(other.blocks) {
+		return false
+	}
+	for bi, b := range v.blocks {
+		ob := other.blocks[bi]
+		bm := blockBitmap(b)
+		if bm != blockBitmap(ob) {
+			return false
+		} else if bm == (bitmap.Bitmap256{}) {
+			continue
+		}
+		equal := true
+		b.Range(func(i uint8, val interface{}) bool {
+			equal = eq(val, ob.Get(i))
+			return equal
+		})
+		if !equal {
+			return false
+		}
+	}
+	return true
+}
+
+// Checksum returns an FNV-1a hash of the present (index, value) pairs, in
+// index order. Values are hashed using their %T and %v formatting.
+func (v *SparseishVector) Checksum() uint64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	v.Range(func(i int, val interface{}) bool {
+		binary.LittleEndian.PutUint64(buf[:], uint64(i))
+		h.Write(buf[:])
+		fmt.Fprintf(h, "%T:%v;", val, val)
+		return true
+	})
+	return h.Sum64()
+}
+
+// SparseishVectorN is a sparse vector with a configurable block size of
+// 1<<blockBits, from 256 to 65536. Each block is a two-level wideBlock of
+// 256-element Sparse256Arrays, so larger blocks shrink the top-level blocks
+// slice, which costs a pointer per block whether or not it has elements.
+// Blocks and their sub-blocks are allocated on first Put.
+type SparseishVectorN struct {
+	blocks    []*wideBlock
+	len       int
+	blockBits uint
+	blockMask int
+	alloc     func() Sparse256Array
+}
+
+// wideBlock is a block of a SparseishVectorN, made of 256-element sub-blocks,
+// which are nil until first Put.
+type wideBlock struct {
+	sub []Sparse256Array
+}
+
+func NewSparseishVectorN(length, blockBits int, allocArray func() Sparse256Array) *SparseishVectorN {
+	if blockBits < 8 || blockBits > 16 {
+		panic(fmt.Sprintf("vectest: blockBits %d not in [8, 16]", blockBits))
+	}
+	blockMask := 1<<blockBits - 1
+	return &SparseishVectorN{
+		blocks:    make([]*wideBlock, (length+blockMask)>>blockBits),
+		len:       length,
+		blockBits: uint(blockBits),
+		blockMask: blockMask,
+		alloc:     allocArray,
+	}
+}
+
+func (v *SparseishVectorN) Len() int {
+	return v.len
+}
+
+func (v *SparseishVectorN) Put(i int, val interface{}) {
+	wb := v.blocks[i>>v.blockBits]
+	if wb == nil {
+		if val == nil {
+			return
+		}
+		wb = &wideBlock{sub: make([]Sparse256Array, 1<<(v.blockBits-8))}
+		v.blocks[i>>v.blockBits] = wb
+	}
+	off := i & v.blockMask
+	b := wb.sub[off>>8]
+	if b == nil {
+		if val == nil {
+			return
+		}
+		b = v.alloc()
+		wb.sub[off>>8] = b
+	}
+	b.Put(uint8(off), val)
+}
+
+func (v *SparseishVectorN) Get(i int) interface{} {
+	wb := v.blocks[i>>v.blockBits]
+	if wb == nil {
+		return nil
+	}
+	off := i & v.blockMask
+	if b := wb.sub[off>>8]; b != nil {
+		return b.Get(uint8(off))
+	}
+	return nil
+}
+
+type MapArray struct {
+	m map[uint8]interface{}
+}
+
+func (a *MapArray) Clear() {
+	a.m = make(map[uint8]interface{})
+}
+
+// ClearRetain clears the array, but keeps the map's allocated buckets for
+// reuse.
+func (a *MapArray) ClearRetain() {
+	for i := range a.m {
+		delete(a.m, i)
+	}
+}
+
+// Reserve pre-sizes an empty map for n elements. Go maps can't be grown in
+// place, so this does nothing if the map has elements.
+func (a *MapArray) Reserve(n int) {
+	if len(a.m) == 0 {
+		a.m = make(map[uint8]interface{}, n)
+	}
+}
+
+func (a *MapArray) Put(i uint8, v interface{}) {
+	if v == nil {
+		delete(a.m, i)
+	} else {
+		a.m[i] = v
+	}
+}
+
+// DeleteMany deletes the elements at indices, returning the number that were
+// present.
+func (a *MapArray) DeleteMany(indices []uint8) int {
+	deleted := 0
+	for _, i := range indices {
+		if _, ok := a.m[i]; ok {
+			delete(a.m, i)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+func (a *MapArray) Get(i uint8) interface{} {
+	return a.m[i]
+}
+
+func (a *MapArray) Len() int {
+	return len(a.m)
+}
+
+func (a *MapArray) Kind() string {
+	return "MapArray"
+}
+
+func (a *MapArray) Range(f func(i uint8, v interface{}) bool) {
+	// Maps are unordered, so probe every index to iterate in order.
+	for i := 0; i < 256; i++ {
+		if v, ok := a.m[uint8(i)]; ok {
+			if !f(uint8(i), v) {
+				return
+			}
+		}
+	}
+}
+
+func (a *MapArray) Clone() Sparse256Array {
+	m := make(map[uint8]interface{}, len(a.m))
+	for i, v := range a.m {
+		m[i] = v
+	}
+	return &MapArray{m: m}
+}
+
+// All returns an iterator over the elements, for use with range.
+func (a *MapArray) All() iter.Seq2[uint8, interface{}] {
+	return a.Range
+}
+
+type binaryArrayItem struct {
+	index uint8
+	v     interface{}
+}
+
+type BinaryArray struct {
+	items []binaryArrayItem
+}
+
+func (a *BinaryArray) Clear() {
+	a.items = nil
+}
+
+// ClearRetain clears the array, but keeps the backing slice for reuse.
+func (a *BinaryArray) ClearRetain() {
+	for n := range a.items {
+		// Drop references to values so they can be collected.
+		a.items[n] = binaryArrayItem{}
+	}
+	a.items = a.items[:0]
+}
+
+// Reserve grows the capacity of the array to at least n elements.
+func (a *BinaryArray) Reserve(n int) {
+	if cap(a.items) < n {
+		items := make([]binaryArrayItem, len(a.items), n)
+		copy(items, a.items)
+		a.items = items
+	}
+}
+
+func (a *BinaryArray) Put(i uint8, v interface{}) {
+	index := sort.Search(len(a.items), func(n int) bool {
+		return a.items[n].index >= i
+	})
+	if index < len(a.items) && a.items[index].index == i {
+		if v == nil {
+			copy(a.items[index:], a.items[index+1:])
+			a.items = a.items[:len(a.items)-1]
+		} else {
+			a.items[index].v = v
+		}
+	} else if v != nil {
+		a.items = append(a.items, binaryArrayItem{})
+		copy(a.items[index+1:], a.items[index:])
+		a.items[index].index = i
+		a.items[index].v = v
+	}
+}
+
+// PutR is Put, but also reports whether the backing slice was reallocated.
+// Appends only reallocate when growing capacity, so a change in capacity means
+// a new slice.
+func (a *BinaryArray) PutR(i uint8, v interface{}) (reallocated bool) {
+	oldCap := cap(a.items)
+	a.Put(i, v)
+	return cap(a.items) != oldCap
+}
+
+// DeleteMany deletes the elements at indices in a single pass over the items,
+// returning the number that were present.
+func (a *BinaryArray) DeleteMany(indices []uint8) int {
+	var del bitmap.Bitmap256
+	for _, i := range indices {
+		del.Set(i)
+	}
+	out := 0
+	for _, item := range a.items {
+		if !del.Get(item.index) {
+			a.items[out] = item
+			out++
+		}
+	}
+	deleted := len(a.items) - out
+	for n := out; n < len(a.items); n++ {
+		a.items[n] = binaryArrayItem{}
+	}
+	a.items = a.items[:out]
+	return deleted
+}
+
+func (a *BinaryArray) Get(i uint8) interface{} {
+	index := sort.Search(len(a.items), func(n int) bool {
+		return a.items[n].index >= i
+	})
+	if index < len(a.items) && a.items[index].index == i {
+		return a.items[index].v
+	}
+	return nil
+}
+
+func (a *BinaryArray) Len() int {
+	return len(a.items)
+}
+
+func (a *BinaryArray) Kind() string {
+	return "BinaryArray"
+}
+
+func (a *BinaryArray) Range(f func(i uint8, v interface{}) bool) {
+	for _, item := range a.items {
+		if !f(item.index, item.v) {
+			return
+		}
+	}
+}
+
+func (a *BinaryArray) Clone() Sparse256Array {
+	return &BinaryArray{items: append([]binaryArrayItem(nil), a.items...)}
+}
+
+// All returns an iterator over the elements, for use with range.
+func (a *BinaryArray) All() iter.Seq2[uint8, interface{}] {
+	return a.Range
+}
+
+// The smallest allocation for a uint8 slice is 8 bytes, so start there.
+const splitBinaryArrayMinCap = 8
+
+type SplitBinaryArray struct {
+	indexes []uint8
+	values  []interface{}
+}
+
+func (a *SplitBinaryArray) Clear() {
+	a.indexes, a.values = nil, nil
+}
+
+func (a *SplitBinaryArray) ClearRetain() {
+	for n := range a.values {
+		a.values[n] = nil
+	}
+	a.indexes, a.values = a.indexes[:0], a.values[:0]
+}
+
+func (a *SplitBinaryArray) Reserve(n int) {
+	if cap(a.indexes) < n {
+		indexes := make([]uint8, len(a.indexes), n)
+		copy(indexes, a.indexes)
+		a.indexes = indexes
+	}
+	if cap(a.values) < n {
+		values := make([]interface{}, len(a.values), n)
+		copy(values, a.values)
+		a.values = values
+	}
+}
+
+func (a *SplitBinaryArray) Put(i uint8, v interface{}) {
+	index := sort.Search(len(a.indexes), func(n int) bool {
+		return a.indexes[n] >= i
+	})
+	if index < len(a.indexes) && a.indexes[index] == i {
+		if v == nil {
+			copy(a.indexes[index:], a.indexes[index+1:])
+			a.indexes = a.indexes[:len(a.indexes)-1]
+
+			copy(a.values[index:], a.values[index+1:])
+			a.values = a.values[:len(a.values)-1]
+		} else {
+			a.values[index] = v
+		}
+	} else if v != nil {
+		if len(a.indexes) == cap(a.indexes) || len(a.values) == cap(a.values) {
+			a.grow()
+		}
+		a.indexes = append(a.indexes, 0)
+		copy(a.indexes[index+1:], a.indexes[index:])
+		a.indexes[index] = i
+
+		a.values = append(a.values, nil)
+		copy(a.values[index+1:], a.values[index:])
+		a.values[index] = v
+	}
+}
+
+// grow doubles the capacity of both slices together, so that they reallocate
+// on the same Put, rather than each following its own append growth.
+func (a *SplitBinaryArray) grow() {
+	newCap := 2 * len(a.values)
+	if newCap < splitBinaryArrayMinCap {
+		newCap = splitBinaryArrayMinCap
+	} else if newCap > 256 {
+		newCap = 256
+	}
+	a.Reserve(newCap)
+}
+
+func (a *SplitBinaryArray) PutR(i uint8, v interface{}) (reallocated bool) {
+	oldIndexesCap, oldValuesCap := cap(a.indexes), cap(a.values)
+	a.Put(i, v)
+	return cap(a.indexes) != oldIndexesCap || cap(a.values) != oldValuesCap
+}
+
+func (a *SplitBinaryArray) DeleteMany(indices []uint8) int {
+	var del bitmap.Bitmap256
+	for _, i := range indices {
+		del.Set(i)
+	}
+	out := 0
+	for n, i := range a.indexes {
+		if !del.Get(i) {
+			a.indexes[out] = i
+			a.values[out] = a.values[n]
+			out++
+		}
+	}
+	deleted := len(a.indexes) - out
+	for n := out; n < len(a.values); n++ {
+		a.values[n] = nil
+	}
+	a.indexes, a.values = a.indexes[:out], a.values[:out]
+	return deleted
+}
+
+func (a *SplitBinaryArray) Get(i uint8) interface{} {
+	index := sort.Search(len(a.indexes), func(n int) bool {
+		return a.indexes[n] >= i
+	})
+	if index < len(a.indexes) && a.indexes[index] == i {
+		return a.values[index]
+	}
+	return nil
+}
+
+func (a *SplitBinaryArray) Len() int {
+	return len(a.indexes)
+}
+
+func (a *SplitBinaryArray) Kind() string {
+	return "SplitBinaryArray"
+}
+
+func (a *SplitBinaryArray) Range(f func(i uint8, v interface{}) bool) {
+	for n, i := range a.indexes {
+		if !f(i, a.values[n]) {
+			return
+		}
+	}
+}
+
+func (a *SplitBinaryArray) Clone() Sparse256Array {
+	return &SplitBinaryArray{
+		indexes: append([]uint8(nil), a.indexes...),
+		values:  append([]interface{}(nil), a.values...),
+	}
+}
+
+// All returns an iterator over the elements, for use with range.
+func (a *SplitBinaryArray) All() iter.Seq2[uint8, interface{}] {
+	return a.Range
+}
+
+// RangeValues is Range without the indices, iterating the values slice
+// directly.
+func (a *SplitBinaryArray) RangeValues(f func(v interface{}) bool) {
+	for _, v := range a.values {
+		if !f(v) {
+			return
+		}
+	}
+}
+
+type BitmapArray struct {
+	bm     bitmap.Bitmap256
+	values []interface{}
+}
+
+func (a *BitmapArray) Clear() {
+	a.bm = bitmap.Bitmap256{}
+	a.values = nil
+}
+
+func (a *BitmapArray) ClearRetain() {
+	for n := range a.values {
+		a.values[n] = nil
+	}
+	a.bm = bitmap.Bitmap256{}
+	a.values = a.values[:0]
+}
+
+func (a *BitmapArray) Reserve(n int) {
+	if cap(a.values) < n {
+		values := make([]interface{}, len(a.values), n)
+		copy(values, a.values)
+		a.values = values
+	}
+}
+
+func (a *BitmapArray) Put(i uint8, v interface{}) {
+	index := a.bm.CountLess(i)
+	if index < len(a.values) && a.bm.Get(i) {
+		if v == nil {
+			a.bm.Clear(i)
+			copy(a.values[index:], a.values[index+1:])
+			a.values = a.values[:len(a.values)-1]
+		} else {
+			a.values[index] = v
+		}
+	} else if v != nil {
+		a.bm.Set(i)
+		a.values = append(a.values, nil)
+		copy(a.values[index+1:], a.values[index:])
+		a.values[index] = v
+	}
+}
+
+func (a *BitmapArray) PutR(i uint8, v interface{}) (reallocated bool) {
+	oldCap := cap(a.values)
+	a.Put(i, v)
+	return cap(a.values) != oldCap
+}
+
+// DeleteMany clears the bits for all of indices, then compacts the values
+// slice once, rather than shifting it for every delete. It returns the number
+// of elements that were present.
+func (a *BitmapArray) DeleteMany(indices []uint8) int {
+	old := a.bm
+	for _, i := range indices {
+		a.bm.Clear(i)
+	}
+	deleted := old.Count() - a.bm.Count()
+	if deleted == 0 {
+		return 0
+	}
+	n, out := 0, 0
+	bitmapForEach(&old, func(i uint8) bool {
+		if a.bm.Get(i) {
+			a.values[out] = a.values[n]
+			out++
+		}
+		n++
+		return true
+	})
+	for j := out; j < len(a.values); j++ {
+		a.values[j] = nil
+	}
+	a.values = a.values[:out]
+	return deleted
+}
+
+func (a *BitmapArray) Get(i uint8) interface{} {
+	index := a.bm.CountLess(i)
+	if index < len(a.values) && a.bm.Get(i) {
+		return a.values[index]
+	}
+	return nil
+}
+
+// GetManyFound returns the value at each of indices, and whether it is present.
+// The bitmap is swept once to count the elements before each word, so each
+// lookup is a single popcount.
+func (a *BitmapArray) GetManyFound(indices []uint8) (values []interface{}, found []bool) {
+	var before [len(a.bm)]int
+	for w := 1; w < len(a.bm); w++ {
+		before[w] = before[w-1] + bits.OnesCount64(a.bm[w-1])
+	}
+	values = make([]interface{}, len(indices))
+	found = make([]bool, len(indices))
+	for n, i := range indices {
+		w, bit := i>>6, uint64(1)<<(i&63)
+		if a.bm[w]&bit != 0 {
+			values[n] = a.values[before[w]+bits.OnesCount64(a.bm[w]&(bit-1))]
+			found[n] = true
+		}
+	}
+	return values, found
+}
+
+// GetRange sets dst[n] to the value at index start+n, or nil if absent. If
+// every element in the window is present, their values are contiguous in the
+// values slice and are copied in one go. start+len(dst) must not exceed 256.
+func (a *BitmapArray) GetRange(start uint8, dst []interface{}) {
+	if len(dst) == 0 {
+		return
+	} else if int(start)+len(dst) > blockSize {
+		panic(fmt.Sprintf("vectest: GetRange window [%d, %d) out of range", start, int(start)+len(dst)))
+	}
+	index := a.bm.CountLess(start)
+	end := start + uint8(len(dst)-1)
+	if BitmapCountLessEqual(&a.bm, end)-index == len(dst) {
+		copy(dst, a.values[index:])
+		return
+	}
+	for n := range dst {
+		if a.bm.Get(start + uint8(n)) {
+			dst[n] = a.values[index]
+			index++
+		} else {
+			dst[n] = nil
+		}
+	}
+}
+
+func (a *BitmapArray) Len() int {
+	return a.bm.Count()
+}
+
+func (a *BitmapArray) Kind() string {
+	return "BitmapArray"
+}
+
+func (a *BitmapArray) Range(f func(i uint8, v interface{}) bool) {
+	n := 0
+	bitmapForEach(&a.bm, func(i uint8) bool {
+		n++
+		return f(i, a.values[n-1])
+	})
+}
+
+func (a *BitmapArray) Clone() Sparse256Array {
+	return &BitmapArray{bm: a.bm, values: append([]interface{}(nil), a.values...)}
+}
+
+// All returns an iterator over the elements, for use with range.
+func (a *BitmapArray) All() iter.Seq2[uint8, interface{}] {
+	return a.Range
+}
+
+// RangeMutable calls f for every element in index order, iterating over a
+// snapshot of the bitmap. The element is replaced with newV, or deleted if keep
+// is false or newV is nil. Values are compacted as the iteration goes, so the
+// array is rebuilt in a single pass. f must not otherwise modify the array.
+func (a *BitmapArray) RangeMutable(f func(i uint8, v interface{}) (newV interface{}, keep bool)) {
+	old := a.bm
+	n, out := 0, 0
+	bitmapForEach(&old, func(i uint8) bool {
+		newV, keep := f(i, a.values[n])
+		n++
+		if keep && newV != nil {
+			a.values[out] = newV
+			out++
+		} else {
+			a.bm.Clear(i)
+		}
+		return true
+	})
+	for j := out; j < len(a.values); j++ {
+		a.values[j] = nil
+	}
+	a.values = a.values[:out]
+}
+
+// FillRange sets every index in [lo, hi) to v, which must not be nil. The
+// range is set in the bitmap a word at a time, and the values slice is rebuilt
+// in a single pass, rather than shifting it for every new element.
+func (a *BitmapArray) FillRange(lo, hi int, v interface{}) {
+	old := a.bm
+	BitmapSetRange(&a.bm, lo, hi)
+	count := a.bm.Count()
+	values := a.values
+	if cap(values) < count {
+		values = make([]interface{}, count)
+	} else {
+		values = values[:count]
+	}
+	if hi-lo == blockSize {
+		for n := range values {
+			values[n] = v
+		}
+		a.values = values
+		return
+	}
+	// Fill from the end, so that when values shares a.values, old values are
+	// read before they are overwritten.
+	n, out := len(a.values)-1, count-1
+	for i := 255; i >= 0; i-- {
+		if !a.bm.Get(uint8(i)) {
+			continue
+		}
+		if old.Get(uint8(i)) {
+			values[out] = a.values[n]
+			n--
+		}
+		if i >= lo && i < hi {
+			values[out] = v
+		}
+		out--
+	}
+	a.values = values
+}
+
+// RangeValues is Range without the indices. Values are stored in index order,
+// so this skips scanning the bitmap.
+func (a *BitmapArray) RangeValues(f func(v interface{}) bool) {
+	for _, v := range a.values {
+		if !f(v) {
+			return
+		}
+	}
+}
+
+// SetArray is a set of uint8 indices. It only records presence, so it has no
+// values slice at all. As a Sparse256Array, Put ignores the value (except nil,
+// which deletes) and Get returns true for present indices.
+type SetArray struct {
+	bm bitmap.Bitmap256
+}
+
+func (a *SetArray) Clear() {
+	a.bm = bitmap.Bitmap256{}
+}
+
+func (a *SetArray) Add(i uint8) {
+	a.bm.Set(i)
+}
+
+func (a *SetArray) Delete(i uint8) {
+	a.bm.Clear(i)
+}
+
+func (a *SetArray) Contains(i uint8) bool {
+	return a.bm.Get(i)
+}
+
+func (a *SetArray) Put(i uint8, v interface{}) {
+	if v == nil {
+		a.bm.Clear(i)
+	} else {
+		a.bm.Set(i)
+	}
+}
+
+func (a *SetArray) Get(i uint8) interface{} {
+	if a.bm.Get(i) {
+		return true
+	}
+	return nil
+}
+
+func (a *SetArray) Len() int {
+	return a.bm.Count()
+}
+
+func (a *SetArray) Kind() string {
+	return "SetArray"
+}
+
+func (a *SetArray) Range(f func(i uint8, v interface{}) bool) {
+	bitmapForEach(&a.bm, func(i uint8) bool {
+		return f(i, true)
+	})
+}
+
+// All returns an iterator over the elements, for use with range.
+func (a *SetArray) All() iter.Seq2[uint8, interface{}] {
+	return a.Range
+}
+
+type arrayType struct {
+	name  string
+	alloc func() Sparse256Array
+}
+
+var arrayTypes = []arrayType{
+	{"MapArray", func() Sparse256Array {
+		return &MapArray{m: make(map[uint8]interface{})}
+	}},
+	{"BinaryArray", func() Sparse256Array {
+		return &BinaryArray{}
+	}},
+	{"SplitBinaryArray", func() Sparse256Array {
+		return &SplitBinaryArray{}
+	}},
+	{"BitmapArray", func() Sparse256Array {
+		return &BitmapArray{}
+	}},
+	{"OpenAddrArray", func() Sparse256Array {
+		return &OpenAddrArray{}
+	}},
+}
+
+// RecommendArrayType returns the name of the array type that is the best
+// space/time tradeoff for blocks with the given expected number of elements.
+//
+// The thresholds come from BenchmarkArrayBlockFill, with 16384 blocks on
+// amd64, which measures Gets, Puts and heap bytes per block (including boxed
+// values and slice slack) at exact per-block fills:
+//
+//	fill  BinaryArray                BitmapArray
+//	1     15ns Get, 58ns Put, 64B    23ns Get, 64ns Put, 96B
+//	2     28ns Get, 94ns Put, 88B    25ns Get, 94ns Put, 112B
+//	3     36ns Get, 140ns Put, 135B  23ns Get, 109ns Put, 144B
+//	4     39ns Get, 119ns Put, 136B  22ns Get, 110ns Put, 144B
+//	6     51ns Get, 155ns Put, 232B  23ns Get, 130ns Put, 208B
+//
+// BinaryArray is both smaller and faster at 1 element, and about the same
+// speed but over 20% smaller at 2. From 3, BitmapArray Gets are over a third
+// faster, for at most 6% more memory, and from 6 it is also the smaller.
+// BenchmarkArrayGet and BenchmarkArrayPut with -arraysize 4194304 agree: at
+// 1% fill (about 2.5 elements per block) BitmapArray takes 22ns per Get and
+// 114ns per Put, against 41ns and 192ns for BinaryArray, and its Get lead
+// holds at every higher fill. Neither MapArray, SplitBinaryArray nor
+// OpenAddrArray is both faster and smaller than these two at any fill.
+func RecommendArrayType(fill int) string {
+	if fill < 3 {
+		return "BinaryArray"
+	}
+	return "BitmapArray"
+}
+
+var arrayTypeFilter = flag.String("arraytype", "",
+	"Comma-separated list of array types to benchmark (default all)")
+
+// benchArrayTypes returns the array types selected by the -arraytype flag. An
+// unknown name stops the run, rather than silently benchmarking nothing.
+func benchArrayTypes() []arrayType {
+	types, err := parseArrayTypes(*arrayTypeFilter)
+	if err != nil {
+		log.Fatalf("-arraytype: %v", err)
+	}
+	return types
+}
+
+// parseArrayTypes returns the array types named in the comma-separated list,
+// or every type if it is empty.
+func parseArrayTypes(list string) ([]arrayType, error) {
+	if list == "" {
+		return arrayTypes, nil
+	}
+	var types []arrayType
+	for _, name := range strings.Split(list, ",") {
+		found := false
+		for _, t := range arrayTypes {
+			if t.name == name {
+				types = append(types, t)
+				found = true
+			}
+		}
+		if !found {
+			valid := make([]string, len(arrayTypes))
+			for n, t := range arrayTypes {
+				valid[n] = t.name
+			}
+			return nil, fmt.Errorf("unknown array type %q, valid types are %s", name, strings.Join(valid, ", "))
+		}
+	}
+	return types, nil
+}
+
+func init() {
+	log.Printf("sizeof(MapArray): %d", unsafe.Sizeof(MapArray{}))
+	log.Printf("sizeof(BinaryArray): %d", unsafe.Sizeof(BinaryArray{}))
+	log.Printf("sizeof(binaryArrayItem): %d", unsafe.Sizeof(binaryArrayItem{}))
+	log.Printf("sizeof(SplitBinaryArray): %d", unsafe.Sizeof(SplitBinaryArray{}))
+	log.Printf("sizeof(BitmapArray): %d", unsafe.Sizeof(BitmapArray{}))
+	log.Printf("sizeof(SetArray): %d", unsafe.Sizeof(SetArray{}))
+	log.Printf("sizeof(OpenAddrArray): %d", unsafe.Sizeof(OpenAddrArray{}))
+	log.Printf("sizeof(PackedBitmapArray[int]): %d", unsafe.Sizeof(PackedBitmapArray[int]{}))
+}
+
+var dataSeed = flag.Int64("seed", 1, "Random seed for generated test data")
+
+// generateTestData returns size random ints in [0, maxInt). The same seed
+// always generates the same data, so benchmark runs are comparable.
+func generateTestData(seed int64, size, maxInt int) []int {
+	rng := rand.New(rand.NewSource(seed))
+	d := make([]int, size)
+	for i := range d {
+		d[i] = rng.Intn(maxInt)
+	}
+	return d
+}
+
+const (
+	ArraySize = 50 * 1000 * 1000
+)
+
+var (
+	FillPercentiles = []int{1, 5, 10, 25, 50, 75, 90, 95, 99}
+
+	arraySize = flag.Int("arraysize", ArraySize,
+		"Vector length and number of test data elements for the array benchmarks")
+	staticTestData lazyTestData
+)
+
+// lazyTestData generates test data on first use, so that test runs which don't
+// need it don't pay the cost. It is safe for concurrent use.
+type lazyTestData struct {
+	once sync.Once
+	data []int
+	// Number of times the data has been generated, for testing.
+	generated int
+}
+
+// get returns the test data, generating it with the given seed and size on the
+// first call. Later calls return the same data, regardless of arguments.
+func (d *lazyTestData) get(seed int64, size int) []int {
+	d.once.Do(func() {
+		d.data = generateTestData(seed, size, size)
+		d.generated++
+	})
+	return d.data
+}
+
+// forArraySize returns the test data for the array benchmarks, sized by the
+// -arraysize flag.
+func (d *lazyTestData) forArraySize() []int {
+	return d.get(*dataSeed, *arraySize)
+}
+
+// benchFillItems returns the number of test data elements for a fill of p
+// percent of -arraysize, which is at least 1 so that small sizes still
+// benchmark something.
+func benchFillItems(b *testing.B, p int) int {
+	if *arraySize < 1 {
+		b.Fatalf("-arraysize %d must be at least 1", *arraySize)
+	}
+	return max((*arraySize*p)/100, 1)
+}
+
+// testValues are pre-boxed values, for benchmarks that shouldn't count the
+// allocation from converting an int to an interface{}.
+var testValues = func() []interface{} {
+	values := make([]interface{}, 1024)
+	for i := range values {
+		values[i] = i + 1000
+	}
+	return values
+}()
+
+// BenchmarkArrayGetCacheCold compares Gets in index order, which touch each
+// block once while it's in cache, against the same Gets in random order across
+// a vector much larger than the CPU caches. The heap size of the vector is
+// reported as MB, as a proxy for cache pressure: the slowdown from Sorted to
+// Random grows as the working set outgrows each level of cache.
+func BenchmarkArrayGetCacheCold(b *testing.B) {
+	const length = 1 << 24
+	for _, p := range []int{1, 10, 50} {
+		probes := generateTestData(*dataSeed, length*p/100, length)
+		sortedProbes := append([]int(nil), probes...)
+		sort.Ints(sortedProbes)
+
+		for _, at := range benchArrayTypes() {
+			before := heapAlloc()
+			v := NewSparseishVector(length, at.alloc)
+			for _, k := range sortedProbes {
+				v.Put(k, testValues[k%len(testValues)])
+			}
+			mb := float64(heapAlloc()-before) / (1 << 20)
+
+			for _, order := range []struct {
+				name   string
+				probes []int
+			}{{"Sorted", sortedProbes}, {"Random", probes}} {
+				b.Run(fmt.Sprintf("%s/%d%%/%s", at.name, p, order.name), func(b *testing.B) {
+					for i := 0; i < b.N; i++ {
+						v.Get(order.probes[i%len(order.probes)])
+					}
+					b.ReportMetric(mb, "MB")
+				})
+			}
+			v = nil
+		}
+	}
+}
+
+func BenchmarkArrayPut(b *testing.B) {
+	for _, p := range FillPercentiles {
+		fillItems := benchFillItems(b, p)
+		testData := staticTestData.forArraySize()[:fillItems]
+		for _, t := range benchArrayTypes() {
+			testName := fmt.Sprintf("%s/%d%%", t.name, p)
+			v := NewSparseishVector(*arraySize, t.alloc)
+			b.Run(testName, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if i > 0 && i%fillItems == 0 {
+						b.StopTimer()
+						v.Clear()
+						b.StartTimer()
+					}
+					k := testData[i%fillItems]
+					v.Put(k, k)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkArrayGet(b *testing.B) {
+	for _, p := range FillPercentiles {
+		fillItems := benchFillItems(b, p)
+		testData := staticTestData.forArraySize()[:fillItems]
+		var sortedTestData []int
+
+		for _, t := range benchArrayTypes() {
+			testName := fmt.Sprintf("%s/%d%%", t.name, p)
+			v := NewSparseishVector(*arraySize, t.alloc)
+			initVec := true
+			b.Run(testName, func(b *testing.B) {
+				if sortedTestData == nil {
+					// Sorting the elements to be inserted is much quicker than
+					// doing it randomly, due to improved cache locality.
+					sortedTestData = append([]int(nil), testData...)
+					sort.Sort(sort.IntSlice(sortedTestData))
+				}
+				if initVec {
 					for _, k := range sortedTestData {
 						v.Put(k, k)
 					}
-					initVec = false
+					initVec = false
+				}
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					k := testData[i%fillItems]
+					v.Get(k)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkArrayBlockFill measures Get and Put with exactly fill elements in
+// every block, for the low fills where the best array type changes. Half the
+// Gets are of present elements and half of random indices. The heap bytes per
+// block, including boxed values, are reported as B/block.
+func BenchmarkArrayBlockFill(b *testing.B) {
+	const numBlocks = 16384
+	for _, fill := range []int{1, 2, 3, 4, 6, 8} {
+		// Take the first fill random keys in each block.
+		var present []int
+		counts := make([]int, numBlocks)
+		for _, k := range generateTestData(*dataSeed, numBlocks*fill*4, numBlocks*blockSize) {
+			if counts[k>>blockBits] < fill {
+				counts[k>>blockBits]++
+				present = append(present, k)
+			}
+		}
+		probes := generateTestData(*dataSeed+1, 1<<16, numBlocks*blockSize)
+
+		for _, at := range benchArrayTypes() {
+			before := heapAlloc()
+			v := NewSparseishVector(numBlocks*blockSize, at.alloc)
+			for _, k := range present {
+				v.Put(k, testValues[k%len(testValues)])
+			}
+			bytesPerBlock := float64(heapAlloc()-before) / numBlocks
+
+			b.Run(fmt.Sprintf("Get/%s/%d", at.name, fill), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if i%2 == 0 {
+						v.Get(present[i/2%len(present)])
+					} else {
+						v.Get(probes[i/2%len(probes)])
+					}
+				}
+				b.ReportMetric(bytesPerBlock, "B/block")
+			})
+			b.Run(fmt.Sprintf("Put/%s/%d", at.name, fill), func(b *testing.B) {
+				w := NewSparseishVector(numBlocks*blockSize, at.alloc)
+				for i := 0; i < b.N; i++ {
+					if i > 0 && i%len(present) == 0 {
+						b.StopTimer()
+						w.Clear()
+						b.StartTimer()
+					}
+					k := present[i%len(present)]
+					w.Put(k, testValues[k%len(testValues)])
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkArrayClear(b *testing.B) {
+	// Refilling the vector between Clears dominates the run time, so use a
+	// smaller vector than the Put/Get benchmarks.
+	const size = 1 << 20
+	for _, p := range FillPercentiles {
+		testData := generateTestData(*dataSeed, (size*p)/100, size)
+		for _, t := range benchArrayTypes() {
+			testName := fmt.Sprintf("%s/%d%%", t.name, p)
+			v := NewSparseishVector(size, t.alloc)
+			b.Run(testName, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					for _, k := range testData {
+						v.Put(k, k)
+					}
+					b.StartTimer()
+					v.Clear()
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkArrayClearRetain(b *testing.B) {
+	const size = 1 << 20
+	testData := generateTestData(*dataSeed, size/2, size)
+	for _, t := range benchArrayTypes() {
+		for _, retain := range []bool{false, true} {
+			testName := t.name + "/Clear"
+			if retain {
+				testName = t.name + "/ClearRetain"
+			}
+			v := NewSparseishVector(size, t.alloc)
+			b.Run(testName, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if retain {
+						v.ClearRetain()
+					} else {
+						v.Clear()
+					}
+					// Use pre-boxed values so that only the array's own
+					// allocations are counted.
+					for n, k := range testData {
+						v.Put(k, testValues[n%len(testValues)])
+					}
+				}
+			})
+		}
+	}
+}
+
+// boxSink stops the compiler optimising away the conversion in
+// BenchmarkBoxingOverhead/BoxOnly.
+var boxSink interface{}
+
+// BenchmarkBoxingOverhead measures the cost of converting an int to an
+// interface{} on Put. Every array is full, so each Put overwrites a value
+// without moving any others. Values are >= 1000 so that the conversion
+// allocates.
+func BenchmarkBoxingOverhead(b *testing.B) {
+	b.Run("BoxOnly", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			boxSink = i + 1000
+		}
+	})
+	for _, at := range benchArrayTypes() {
+		a := at.alloc()
+		for i := 0; i < 256; i++ {
+			a.Put(uint8(i), testValues[i])
+		}
+		b.Run(at.name+"/Boxed", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				a.Put(uint8(i), i+1000)
+			}
+		})
+		b.Run(at.name+"/PreBoxed", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				a.Put(uint8(i), testValues[i%len(testValues)])
+			}
+		})
+	}
+	b.Run("PackedBitmapArray[int]/Generic", func(b *testing.B) {
+		var a PackedBitmapArray[int]
+		for i := 0; i < 256; i++ {
+			a.Set(uint8(i), i)
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			a.Set(uint8(i), i+1000)
+		}
+	})
+}
+
+func BenchmarkArray256Worse(b *testing.B) {
+	var a BitmapArray
+	for i := 0; i < 256; i++ {
+		a.Put(uint8(i), 7)
+	}
+
+	for i := 0; i < b.N; i++ {
+		a.Put(0, nil)
+		a.Put(0, 1)
+	}
+}
+
+// BenchmarkArray256WorseByType is BenchmarkArray256Worse for each slice-backed
+// array type, deleting and re-inserting index 0 of a full block so every
+// element after it is shifted. The block stays full between iterations.
+func BenchmarkArray256WorseByType(b *testing.B) {
+	for _, at := range benchArrayTypes() {
+		switch at.name {
+		case "BinaryArray", "SplitBinaryArray", "BitmapArray":
+		default:
+			continue
+		}
+		b.Run(at.name, func(b *testing.B) {
+			a := at.alloc()
+			for i := 0; i < 256; i++ {
+				a.Put(uint8(i), 7)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				a.Put(0, nil)
+				a.Put(0, 1)
+			}
+		})
+	}
+}
+
+type largeValue struct {
+	data [1024]byte
+}
+
+// BenchmarkLargeValue deletes and re-inserts index 0 of a full block, with
+// small and large values. Values are boxed in interface{}s, so the slice
+// shifts only move 16-byte interface values, whatever the size of the value.
+func BenchmarkLargeValue(b *testing.B) {
+	// The large struct is boxed by copying it to the heap once, here.
+	values := []struct {
+		name string
+		v    interface{}
+	}{
+		{"Int", 7},
+		{"LargeStruct", largeValue{}},
+		{"LargePointer", &largeValue{}},
+	}
+
+	for _, at := range benchArrayTypes() {
+		switch at.name {
+		case "MapArray", "BitmapArray":
+		default:
+			continue
+		}
+		for _, val := range values {
+			v := val.v
+			b.Run(at.name+"/"+val.name, func(b *testing.B) {
+				a := at.alloc()
+				for i := 0; i < 256; i++ {
+					a.Put(uint8(i), v)
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					a.Put(0, nil)
+					a.Put(0, v)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkSplitBinaryArrayFill fills a SplitBinaryArray in random order,
+// reporting the number of slice reallocations.
+func BenchmarkSplitBinaryArrayFill(b *testing.B) {
+	rng := rand.New(rand.NewSource(*dataSeed))
+	for _, fill := range []int{16, 64, 256} {
+		keys := rng.Perm(256)[:fill]
+		b.Run(strconv.Itoa(fill), func(b *testing.B) {
+			reallocs := 0
+			for i := 0; i < b.N; i++ {
+				var a SplitBinaryArray
+				for _, k := range keys {
+					indexesCap, valuesCap := cap(a.indexes), cap(a.values)
+					a.Put(uint8(k), testValues[k])
+					if cap(a.indexes) != indexesCap {
+						reallocs++
+					}
+					if cap(a.values) != valuesCap {
+						reallocs++
+					}
+				}
+			}
+			b.ReportMetric(float64(reallocs)/float64(b.N), "reallocs/op")
+		})
+	}
+}
+
+// BenchmarkArrayRange iterates over every element of a block, reporting the
+// time per element yielded. Range is in index order, so MapArray and
+// OpenAddrArray probe all 256 indices rather than iterating their tables, and
+// their cost per element falls as the fill rises. MapIteration measures a
+// plain range over a map of the same elements, for comparison.
+func BenchmarkArrayRange(b *testing.B) {
+	rng := rand.New(rand.NewSource(*dataSeed))
+	for _, p := range FillPercentiles {
+		fill := 256 * p / 100
+		if fill == 0 {
+			fill = 1
+		}
+		keys := rng.Perm(256)[:fill]
+		for _, at := range benchArrayTypes() {
+			b.Run(fmt.Sprintf("%s/%d%%", at.name, p), func(b *testing.B) {
+				a := at.alloc()
+				for _, k := range keys {
+					a.Put(uint8(k), testValues[k])
+				}
+				b.ResetTimer()
+				n := 0
+				for i := 0; i < b.N; i++ {
+					a.Range(func(uint8, interface{}) bool {
+						n++
+						return true
+					})
+				}
+				b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(n), "ns/elem")
+			})
+
+			if at.name != "MapArray" {
+				continue
+			}
+			// Plain map iteration, in the map's own order, for comparison
+			// with MapArray.Range's in-order probing.
+			b.Run(fmt.Sprintf("MapIteration/%d%%", p), func(b *testing.B) {
+				m := make(map[uint8]interface{})
+				for _, k := range keys {
+					m[uint8(k)] = testValues[k]
+				}
+				b.ResetTimer()
+				n := 0
+				for i := 0; i < b.N; i++ {
+					for range m {
+						n++
+					}
+				}
+				b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(n), "ns/elem")
+			})
+		}
+	}
+}
+
+// convertBlock copies src into a new array from alloc, reserving space first
+// where supported. Elements are added in index order, so Puts append.
+func convertBlock(src Sparse256Array, alloc func() Sparse256Array) Sparse256Array {
+	dst := alloc()
+	if r, ok := dst.(interface{ Reserve(n int) }); ok {
+		r.Reserve(src.Len())
+	}
+	src.Range(func(i uint8, v interface{}) bool {
+		dst.Put(i, v)
+		return true
+	})
+	return dst
+}
+
+// BenchmarkConvert measures the cost of converting a block between
+// SplitBinaryArray and BitmapArray, as an adaptive array switching
+// representation would. This bounds how often it can afford to switch.
+func BenchmarkConvert(b *testing.B) {
+	toSplit := func() Sparse256Array { return &SplitBinaryArray{} }
+	toBitmap := func() Sparse256Array { return &BitmapArray{} }
+	rng := rand.New(rand.NewSource(*dataSeed))
+	for _, fill := range []int{4, 16, 64, 128, 256} {
+		keys := rng.Perm(256)[:fill]
+		split, bm := toSplit(), toBitmap()
+		for _, k := range keys {
+			split.Put(uint8(k), testValues[k])
+			bm.Put(uint8(k), testValues[k])
+		}
+
+		b.Run(fmt.Sprintf("%d/SplitToBitmap", fill), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				convertBlock(split, toBitmap)
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*fill), "ns/elem")
+		})
+		b.Run(fmt.Sprintf("%d/BitmapToSplit", fill), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				convertBlock(bm, toSplit)
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*fill), "ns/elem")
+		})
+	}
+}
+
+func BenchmarkArray256Mid(b *testing.B) {
+	var a BitmapArray
+	for i := 0; i < 256; i++ {
+		a.Put(uint8(i), 7)
+	}
+
+	for i := 0; i < b.N; i++ {
+		a.Put(128, nil)
+		a.Put(128, 1)
+	}
+}
+
+func BenchmarkArray256Best(b *testing.B) {
+	var a BitmapArray
+	for i := 0; i < 256; i++ {
+		a.Put(uint8(i), 7)
+	}
+
+	for i := 0; i < b.N; i++ {
+		a.Put(255, nil)
+		a.Put(255, 1)
+	}
+}
+
+func BenchmarkArray256Assign(b *testing.B) {
+	var a BitmapArray
+
+	for i := 0; i < b.N; i++ {
+		a.Put(uint8(i), i)
+	}
+}
+
+func BenchmarkArray256Get(b *testing.B) {
+	var a BitmapArray
+	for i := 0; i < 16; i++ {
+		a.Put(uint8(i), i)
+	}
+
+	for i := 0; i < b.N; i++ {
+		_ = a.Get(uint8(i))
+	}
+}
+
+func BenchmarkSetArrayAdd(b *testing.B) {
+	var a SetArray
+
+	for i := 0; i < b.N; i++ {
+		a.Add(uint8(i))
+	}
+}
+
+func BenchmarkSetArrayContains(b *testing.B) {
+	var a SetArray
+	for i := 0; i < 16; i++ {
+		a.Add(uint8(i))
+	}
+
+	for i := 0; i < b.N; i++ {
+		_ = a.Contains(uint8(i))
+	}
+}
+
+func BenchmarkMap(b *testing.B) {
+	a := make(map[uint8]interface{})
+	for i := 1; i < 16; i++ {
+		a[uint8(i)] = i
+	}
+
+	for i := 0; i < b.N; i++ {
+		a[uint8(i)] = 1
+		delete(a, uint8(i))
+	}
+}
+
+func BenchmarkMapAssign(b *testing.B) {
+	a := make(map[uint8]interface{})
+
+	for i := 0; i < b.N; i++ {
+		a[uint8(i)] = 1
+	}
+}
+
+func BenchmarkMapGet(b *testing.B) {
+	a := make(map[uint8]interface{})
+	for i := 0; i < 16; i++ {
+		a[uint8(i)] = i
+	}
+
+	for i := 0; i < b.N; i++ {
+		_ = a[uint8(i)]
+	}
+}
+
+// getDiv is the original division-based form of Get, kept to check the
+// shift/mask form against.
+func (v *SparseishVector) getDiv(i int) interface{} {
+	return v.blocks[i/256].Get(uint8(i % 256))
+}
+
+func TestSparseishVectorBlockBoundaries(t *testing.T) {
+	const length = 4 * blockSize
+	for _, at := range arrayTypes {
+		v := NewSparseishVector(length, at.alloc)
+		for b := 0; b < length; b += blockSize {
+			for _, i := range []int{b, b + 1, b + blockSize - 1} {
+				v.Put(i, i)
+			}
+		}
+		for i := 0; i < length; i++ {
+			if i>>blockBits != i/256 || i&blockMask != i%256 {
+				t.Fatalf("Index %d: shift/mask (%d, %d) != div/mod (%d, %d)",
+					i, i>>blockBits, i&blockMask, i/256, i%256)
+			}
+			got, want := v.Get(i), v.getDiv(i)
+			if got != want {
+				t.Errorf("%s: Get(%d) %v != division form %v", at.name, i, got, want)
+			}
+			off := i % blockSize
+			if off == 0 || off == 1 || off == blockSize-1 {
+				if got != i {
+					t.Errorf("%s: Get(%d) %v != expected %d", at.name, i, got, i)
+				}
+			} else if got != nil {
+				t.Errorf("%s: Get(%d) %v != expected nil", at.name, i, got)
+			}
+		}
+	}
+}
+
+func BenchmarkVectorGetIndexing(b *testing.B) {
+	const length = 1 << 16
+	v := NewSparseishVector(length, func() Sparse256Array {
+		return &BitmapArray{}
+	})
+	for i := 0; i < length; i += 3 {
+		v.Put(i, i)
+	}
+	testData := generateTestData(*dataSeed, 4096, length)
+
+	b.Run("Div", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			v.getDiv(testData[i%len(testData)])
+		}
+	})
+	b.Run("ShiftMask", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			v.Get(testData[i%len(testData)])
+		}
+	})
+}
+
+func BenchmarkContainsAll(b *testing.B) {
+	const length = 1 << 16
+	for _, at := range benchArrayTypes() {
+		v := NewSparseishVector(length, at.alloc)
+		for i := 0; i < length; i += 3 {
+			v.Put(i, testValues[i%len(testValues)])
+		}
+		probes := generateTestData(*dataSeed, 16384, length)
+
+		b.Run(at.name+"/ContainsAll", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				v.ContainsAll(probes)
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(probes)), "ns/probe")
+		})
+		b.Run(at.name+"/At", func(b *testing.B) {
+			found := make([]bool, len(probes))
+			for i := 0; i < b.N; i++ {
+				for n, k := range probes {
+					_, found[n] = v.At(k)
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(probes)), "ns/probe")
+		})
+	}
+}
+
+func TestSparseishVectorClearRange(t *testing.T) {
+	const (
+		length = 4 * blockSize
+		lo     = 200
+		hi     = 3*blockSize + 32
+	)
+	for _, at := range arrayTypes {
+		v := NewSparseishVector(length, at.alloc)
+		for i := 0; i < length; i++ {
+			v.Put(i, i)
+		}
+		v.ClearRange(lo, hi)
+		for i := 0; i < length; i++ {
+			got := v.Get(i)
+			if i >= lo && i < hi {
+				if got != nil {
+					t.Errorf("%s: Get(%d) %v != expected nil", at.name, i, got)
+				}
+			} else if got != i {
+				t.Errorf("%s: Get(%d) %v != expected %d", at.name, i, got, i)
+			}
+		}
+	}
+}
+
+func TestBenchArrayTypes(t *testing.T) {
+	defer func(old string) { *arrayTypeFilter = old }(*arrayTypeFilter)
+
+	*arrayTypeFilter = ""
+	if got := benchArrayTypes(); len(got) != len(arrayTypes) {
+		t.Errorf("Default selected %d types != expected %d", len(got), len(arrayTypes))
+	}
+
+	*arrayTypeFilter = "BitmapArray"
+	got := benchArrayTypes()
+	if len(got) != 1 || got[0].name != "BitmapArray" {
+		t.Errorf("Filter BitmapArray selected %v", got)
+	}
+
+	*arrayTypeFilter = "MapArray,SplitBinaryArray"
+	got = benchArrayTypes()
+	if len(got) != 2 || got[0].name != "MapArray" || got[1].name != "SplitBinaryArray" {
+		t.Errorf("Filter MapArray,SplitBinaryArray selected %v", got)
+	}
+
+	for _, bad := range []string{"BitmapArary", "BitmapArray,", "BitmapArray,Nope"} {
+		_, err := parseArrayTypes(bad)
+		if err == nil {
+			t.Errorf("parseArrayTypes(%q) succeeded", bad)
+		} else if !strings.Contains(err.Error(), "OpenAddrArray") {
+			t.Errorf("parseArrayTypes(%q) error %q doesn't list the valid types", bad, err)
+		}
+	}
+}
+
+func TestSparseishVectorRange(t *testing.T) {
+	const length = 4 * blockSize
+	testData := generateTestData(*dataSeed, 100, length)
+	ref := make(map[int]int)
+	for _, k := range testData {
+		ref[k] = k
+	}
+	for _, at := range arrayTypes {
+		v := NewSparseishVector(length, at.alloc)
+		for _, k := range testData {
+			v.Put(k, k)
+		}
+		last := -1
+		count := 0
+		v.Range(func(i int, val interface{}) bool {
+			if i <= last {
+				t.Errorf("%s: Range index %d not after %d", at.name, i, last)
+			}
+			if val != ref[i] {
+				t.Errorf("%s: Range value at %d %v != expected %d", at.name, i, val, ref[i])
+			}
+			last = i
+			count++
+			return true
+		})
+		if count != len(ref) {
+			t.Errorf("%s: Range count %d != expected %d", at.name, count, len(ref))
+		}
+	}
+}
+
+func TestSparseishVectorMap(t *testing.T) {
+	const length = 5*blockSize + 17
+	testData := generateTestData(*dataSeed, 500, length)
+	double := func(i int, v interface{}) interface{} {
+		if i%7 == 0 {
+			return nil
+		}
+		return v.(int) * 2
+	}
+	for _, at := range arrayTypes {
+		v := NewSparseishVector(length, at.alloc)
+		present := make(map[int]bool)
+		for _, k := range testData {
+			v.Put(k, k)
+			present[k] = true
+		}
+		checksum := v.Checksum()
+
+		c := v.MapCopy(double)
+		if v.Checksum() != checksum {
+			t.Errorf("%s: MapCopy modified the source vector", at.name)
+		}
+		v.Map(double)
+		for i := 0; i < length; i++ {
+			var expected interface{}
+			if present[i] && i%7 != 0 {
+				expected = i * 2
+			}
+			if v.Get(i) != expected {
+				t.Errorf("%s: Map Get(%d) %v != expected %v", at.name, i, v.Get(i), expected)
+			}
+			if c.Get(i) != expected {
+				t.Errorf("%s: MapCopy Get(%d) %v != expected %v", at.name, i, c.Get(i), expected)
+			}
+		}
+
+		// Blocks which are empty, or whose elements all map to nil, are left
+		// unallocated in the copy.
+		e := NewSparseishVector(length, at.alloc)
+		e.Put(blockSize+1, 1)
+		e.Put(3*blockSize+2, 770)
+		e.Put(3*blockSize+9, 777)
+		c = e.MapCopy(double)
+		for bi, b := range c.blocks {
+			if (b != nil) != (bi == 1) {
+				t.Errorf("%s: MapCopy block %d allocated %v, expected %v", at.name, bi, b != nil, bi == 1)
+			}
+		}
+	}
+}
+
+func TestSparseishVectorFilter(t *testing.T) {
+	const length = 20*blockSize + 17
+	testData := generateTestData(*dataSeed, 2000, length)
+	// Only elements in the first two blocks match.
+	pred := func(i int, v interface{}) bool {
+		return i < 2*blockSize && v.(int)%3 == 0
+	}
+	for _, at := range arrayTypes {
+		v := NewSparseishVector(length, at.alloc)
+		for _, k := range testData {
+			v.Put(k, k)
+		}
+		f := v.Filter(pred)
+
+		var expected []int
+		v.Range(func(i int, val interface{}) bool {
+			if pred(i, val) {
+				expected = append(expected, i)
+			}
+			return true
+		})
+		var got []int
+		f.Range(func(i int, val interface{}) bool {
+			if val != i {
+				t.Errorf("%s: Filter value at %d %v != expected %d", at.name, i, val, i)
+			}
+			got = append(got, i)
+			return true
+		})
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: Filter indices %v != expected %v", at.name, got, expected)
+		}
+		if f.Len() != v.Len() {
+			t.Errorf("%s: Filter length %d != expected %d", at.name, f.Len(), v.Len())
+		}
+
+		allocated := 0
+		for _, b := range f.blocks {
+			if b != nil {
+				allocated++
+			}
+		}
+		if allocated > 2 {
+			t.Errorf("%s: Filter allocated %d blocks > expected 2", at.name, allocated)
+		}
+
+		// The lazily allocated result is still a usable vector.
+		if f.Get(length-1) != nil || f.Count() != len(expected) || f.IsEmpty() != (len(expected) == 0) {
+			t.Errorf("%s: Filter result (%v, %d, %v) != expected (nil, %d, %v)", at.name,
+				f.Get(length-1), f.Count(), f.IsEmpty(), len(expected), len(expected) == 0)
+		}
+		f.Put(length-1, 1)
+		f.ClearRange(0, length-1)
+		if f.Count() != 1 || f.Get(length-1) != 1 {
+			t.Errorf("%s: Filter result after Put/ClearRange (%d, %v) != expected (1, 1)",
+				at.name, f.Count(), f.Get(length-1))
+		}
+		var buf bytes.Buffer
+		if _, err := f.WriteTo(&buf); err != nil {
+			t.Errorf("%s: Filter result WriteTo error: %v", at.name, err)
+		}
+	}
+}
+
+func TestArraySizeFlag(t *testing.T) {
+	defer flag.Set("arraysize", strconv.Itoa(*arraySize))
+	if err := flag.Set("arraysize", "1234"); err != nil {
+		t.Fatal(err)
+	}
+	var d lazyTestData
+	if data := d.forArraySize(); len(data) != 1234 {
+		t.Errorf("Test data length %d != expected 1234", len(data))
+	}
+}
+
+func TestLazyTestData(t *testing.T) {
+	const size = 1000
+	var d lazyTestData
+	var wg sync.WaitGroup
+	results := make([][]int, 8)
+	for n := range results {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			results[n] = d.get(*dataSeed, size)
+		}(n)
+	}
+	wg.Wait()
+	if d.generated != 1 {
+		t.Errorf("Data generated %d times != expected 1", d.generated)
+	}
+	for n, r := range results {
+		if len(r) != size || &r[0] != &results[0][0] {
+			t.Errorf("Result %d (len %d) not the shared data of len %d", n, len(r), size)
+		}
+	}
+	for _, k := range results[0] {
+		if k < 0 || k >= size {
+			t.Fatalf("Value %d out of range [0, %d)", k, size)
+		}
+	}
+	if d.get(*dataSeed, 2*size); d.generated != 1 || len(d.data) != size {
+		t.Errorf("Second get regenerated data (%d times, len %d)", d.generated, len(d.data))
+	}
+}
+
+func TestSparseishVectorCap(t *testing.T) {
+	for _, length := range []int{0, 1, blockSize - 1, blockSize, 3*blockSize + 17} {
+		v := NewSparseishVector(length, arrayTypes[0].alloc)
+		if v.Cap() != len(v.blocks)*blockSize || v.Cap() < length || v.Cap()-length >= blockSize {
+			t.Errorf("Length %d: Cap %d with %d blocks", length, v.Cap(), len(v.blocks))
+		}
+		for i := length; i < v.Cap(); i++ {
+			v.Put(i, i)
+		}
+		for i := length; i < v.Cap(); i++ {
+			if v.Get(i) != i {
+				t.Errorf("Length %d: Get(%d) %v != expected %d", length, i, v.Get(i), i)
+			}
+		}
+	}
+}
+
+func TestSparseishVectorGrow(t *testing.T) {
+	v := NewSparseishVector(0, arrayTypes[0].alloc)
+	reallocs := 0
+	for n := 0; n < 10000; n++ {
+		oldCap := cap(v.blocks)
+		v.Grow(100)
+		if cap(v.blocks) != oldCap {
+			reallocs++
+			if oldCap > 0 && cap(v.blocks) < oldCap*5/4 {
+				t.Errorf("Blocks capacity grew from %d to %d, expected at least %d",
+					oldCap, cap(v.blocks), oldCap*5/4)
+			}
+		}
+		// Touch the last index, so only some blocks are allocated.
+		if n%10 == 0 {
+			v.Put(v.Len()-1, n)
+		}
+	}
+	if v.Len() != 1000000 || len(v.blocks) != (1000000+blockMask)>>blockBits {
+		t.Errorf("Length %d (%d blocks) != expected 1000000", v.Len(), len(v.blocks))
+	}
+	if reallocs > 50 {
+		t.Errorf("Blocks slice reallocated %d times, expected geometric growth", reallocs)
+	}
+	allocated := 0
+	for _, b := range v.blocks {
+		if b != nil {
+			allocated++
+		}
+	}
+	if allocated != v.Count() {
+		t.Errorf("%d blocks allocated != expected %d", allocated, v.Count())
+	}
+	if v.Get(1099) != 10 || v.Get(999099) != 9990 {
+		t.Errorf("Get (%v, %v) != expected (10, 9990)", v.Get(1099), v.Get(999099))
+	}
+}
+
+func TestSparseishVectorForEachBlockBitmap(t *testing.T) {
+	const length = 5*blockSize + 17
+	testData := generateTestData(*dataSeed, 300, length)
+	for _, at := range arrayTypes {
+		v := NewSparseishVector(length, at.alloc)
+		expected := make(map[int]bool)
+		for _, k := range testData {
+			v.Put(k, k)
+			expected[k] = true
+		}
+		v.blocks[2] = nil
+
+		got := make(map[int]bool)
+		v.ForEachBlockBitmap(func(bi int, bm bitmap.Bitmap256) {
+			if bi == 2 {
+				t.Errorf("%s: Called for nil block %d", at.name, bi)
+			}
+			bitmapForEach(&bm, func(i uint8) bool {
+				got[bi<<blockBits+int(i)] = true
+				return true
+			})
+			// The bitmap is a copy.
+			bm.Set(0)
+		})
+		for k := range expected {
+			if k>>blockBits == 2 {
+				delete(expected, k)
+			}
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: Indices from bitmaps %v != expected %v", at.name, got, expected)
+		}
+		if bm := blockBitmap(v.blocks[0]); bm.Get(0) != expected[0] {
+			t.Errorf("%s: Modifying the bitmap changed the block", at.name)
+		}
+	}
+}
+
+func TestAll(t *testing.T) {
+	const length = 5*blockSize + 17
+	testData := generateTestData(*dataSeed, 300, length)
+	type element struct {
+		i int
+		v interface{}
+	}
+	for _, at := range arrayTypes {
+		v := NewSparseishVector(length, at.alloc)
+		for _, k := range testData {
+			v.Put(k, k)
+		}
+
+		var expected, got []element
+		v.Range(func(i int, val interface{}) bool {
+			expected = append(expected, element{i, val})
+			return true
+		})
+		for i, val := range v.All() {
+			got = append(got, element{i, val})
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: Vector All %v != expected %v", at.name, got, expected)
+		}
+
+		b := v.blocks[0].(interface {
+			All() iter.Seq2[uint8, interface{}]
+		})
+		expected, got = expected[:0], got[:0]
+		v.blocks[0].Range(func(i uint8, val interface{}) bool {
+			expected = append(expected, element{int(i), val})
+			return true
+		})
+		for i, val := range b.All() {
+			got = append(got, element{int(i), val})
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: Block All %v != expected %v", at.name, got, expected)
+		}
+
+		n := 0
+		for range v.All() {
+			n++
+			if n == 3 {
+				break
+			}
+		}
+		if n != 3 {
+			t.Errorf("%s: Iterated %d elements before break != expected 3", at.name, n)
+		}
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	for _, at := range arrayTypes {
+		a := at.alloc()
+		a.Put(1, 10)
+
+		if CompareAndSwap(a, 1, 11, 12, nil) || a.Get(1) != 10 {
+			t.Errorf("%s: CAS with wrong old value succeeded, value %v", at.name, a.Get(1))
+		}
+		if !CompareAndSwap(a, 1, 10, 12, nil) || a.Get(1) != 12 {
+			t.Errorf("%s: CAS with matching old value failed, value %v", at.name, a.Get(1))
+		}
+		// Absent elements only match nil.
+		if CompareAndSwap(a, 2, 12, 20, nil) || a.Get(2) != nil {
+			t.Errorf("%s: CAS on absent element succeeded, value %v", at.name, a.Get(2))
+		}
+		if !CompareAndSwap(a, 2, nil, 20, nil) || a.Get(2) != 20 {
+			t.Errorf("%s: CAS inserting absent element failed, value %v", at.name, a.Get(2))
+		}
+		if CompareAndSwap(a, 2, nil, 21, nil) {
+			t.Errorf("%s: CAS expecting absent element succeeded on present element", at.name)
+		}
+		if !CompareAndSwap(a, 2, 20, nil, nil) || a.Get(2) != nil {
+			t.Errorf("%s: CAS delete failed, value %v", at.name, a.Get(2))
+		}
+
+		// Non-comparable values, with a caller-supplied equality.
+		a.Put(3, []int{1, 2})
+		sameLen := func(x, y interface{}) bool {
+			return len(x.([]int)) == len(y.([]int))
+		}
+		if !CompareAndSwap(a, 3, []int{5, 6}, []int{3}, sameLen) {
+			t.Errorf("%s: CAS with custom equality failed", at.name)
+		}
+		if !CompareAndSwap(a, 3, []int{3}, 30, nil) || a.Get(3) != 30 {
+			t.Errorf("%s: CAS on non-comparable value failed, value %v", at.name, a.Get(3))
+		}
+	}
+}
+
+func TestSparseishVectorEqual(t *testing.T) {
+	const length = 5*blockSize + 17
+	testData := generateTestData(*dataSeed, 300, length)
+	vectors := make([]*SparseishVector, len(arrayTypes))
+	for n, at := range arrayTypes {
+		vectors[n] = NewSparseishVector(length, at.alloc)
+		for _, k := range testData {
+			vectors[n].Put(k, k)
+		}
+	}
+	// An unallocated block equals an empty one.
+	vectors[0].blocks[4].Clear()
+	vectors[1].blocks[4] = nil
+	for _, v := range vectors[2:] {
+		v.ClearRange(4*blockSize, 5*blockSize)
+	}
+
+	for n, v := range vectors {
+		for m, o := range vectors {
+			if !v.Equal(o) {
+				t.Errorf("%s != %s", arrayTypes[n].name, arrayTypes[m].name)
+			}
+		}
+	}
+
+	a, b := vectors[0], vectors[len(vectors)-1]
+	b.Put(testData[0], "changed")
+	if a.Equal(b) || b.Equal(a) {
+		t.Errorf("Vectors with a changed value compare equal")
+	}
+	b.Put(testData[0], nil)
+	if a.Equal(b) || b.Equal(a) {
+		t.Errorf("Vectors with a deleted element compare equal")
+	}
+	b.Put(testData[0], testData[0])
+	if !a.Equal(b) {
+		t.Errorf("Restored vectors compare unequal")
+	}
+	if a.Equal(NewSparseishVector(length+1, arrayTypes[0].alloc)) {
+		t.Errorf("Vectors with different lengths compare equal")
+	}
+}
+
+func TestConcat(t *testing.T) {
+	lengths := []int{blockSize + 17, 3, 2*blockSize - 1, blockSize}
+	for _, at := range arrayTypes {
+		var vectors []*SparseishVector
+		expected := make(map[int]interface{})
+		offset := 0
+		for n, length := range lengths {
+			v := NewSparseishVector(length, at.alloc)
+			for _, k := range generateTestData(int64(n), length/2, length) {
+				v.Put(k, k*10+n)
+				expected[offset+k] = k*10 + n
+			}
+			// The last index, to catch off-by-one errors at the boundaries.
+			v.Put(length-1, -n)
+			expected[offset+length-1] = -n
+			vectors = append(vectors, v)
+			offset += length
+		}
+
+		c := Concat(vectors...)
+		if c.Len() != offset {
+			t.Errorf("%s: Concat length %d != expected %d", at.name, c.Len(), offset)
+		}
+		for i := 0; i < c.Len(); i++ {
+			if c.Get(i) != expected[i] {
+				t.Errorf("%s: Get(%d) %v != expected %v", at.name, i, c.Get(i), expected[i])
+			}
+		}
+	}
+	if Concat() != nil {
+		t.Errorf("Concat of no vectors != nil")
+	}
+}
+
+func TestSparseishVectorSlice(t *testing.T) {
+	const length = 5*blockSize + 17
+	testData := generateTestData(*dataSeed, 600, length)
+	ranges := [][2]int{
+		{0, length},
+		{0, 0},
+		{blockSize - 3, blockSize + 3},
+		{17, 3*blockSize + 200},
+		{2 * blockSize, 3 * blockSize},
+		{length - 5, length},
+	}
+	for _, at := range arrayTypes {
+		v := NewSparseishVector(length, at.alloc)
+		for _, k := range testData {
+			v.Put(k, k)
+		}
+		for _, r := range ranges {
+			lo, hi := r[0], r[1]
+			s := v.Slice(lo, hi)
+			if s.Len() != hi-lo {
+				t.Errorf("%s: Slice [%d:%d] length %d != expected %d", at.name, lo, hi, s.Len(), hi-lo)
+			}
+			count := 0
+			for i := 0; i < s.Len(); i++ {
+				if s.Get(i) != v.Get(lo+i) {
+					t.Errorf("%s: Slice [%d:%d] Get(%d) %v != expected %v",
+						at.name, lo, hi, i, s.Get(i), v.Get(lo+i))
+				} else if s.Get(i) != nil {
+					count++
+				}
+			}
+			// No elements from beyond hi.
+			if s.Count() != count {
+				t.Errorf("%s: Slice [%d:%d] count %d != expected %d", at.name, lo, hi, s.Count(), count)
+			}
+		}
+
+		// The slice is a copy.
+		s := v.Slice(0, blockSize)
+		s.Put(0, "changed")
+		if v.Get(0) == "changed" {
+			t.Errorf("%s: Changing the slice changed the vector", at.name)
+		}
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Slice with hi > length didn't panic")
+			}
+		}()
+		NewSparseishVector(10, arrayTypes[0].alloc).Slice(0, 11)
+	}()
+}
+
+func TestGetAllocs(t *testing.T) {
+	keys := rand.New(rand.NewSource(*dataSeed)).Perm(256)[:128]
+	for _, at := range arrayTypes {
+		a := at.alloc()
+		for _, k := range keys {
+			a.Put(uint8(k), testValues[k])
+		}
+		i := 0
+		allocs := testing.AllocsPerRun(1000, func() {
+			a.Get(uint8(i))
+			i++
+		})
+		if allocs > 0 {
+			t.Errorf("%s: Get performed %v allocations, expected 0", at.name, allocs)
+		}
+	}
+}
+
+func TestBuildFromPairs(t *testing.T) {
+	const length = 5*blockSize + 17
+	testData := generateTestData(*dataSeed, 1000, length)
+	pairs := make([]Pair, len(testData))
+	expected := make(map[int]interface{})
+	for n, k := range testData {
+		// Many indices appear more than once, and the last value wins.
+		pairs[n] = Pair{k, n}
+		if n%10 == 0 {
+			pairs[n].V = nil
+		}
+		expected[k] = pairs[n].V
+	}
+	pairs = append(pairs, Pair{length - 1, "last"})
+	expected[length-1] = "last"
+	orig := append([]Pair(nil), pairs...)
+
+	for _, at := range arrayTypes {
+		v := BuildFromPairs(length, pairs, at.alloc)
+		if v.Len() != length {
+			t.Errorf("%s: Length %d != expected %d", at.name, v.Len(), length)
+		}
+		for i := 0; i < length; i++ {
+			if v.Get(i) != expected[i] {
+				t.Errorf("%s: Get(%d) %v != expected %v", at.name, i, v.Get(i), expected[i])
+			}
+		}
+		if !reflect.DeepEqual(pairs, orig) {
+			t.Errorf("%s: BuildFromPairs modified its input", at.name)
+		}
+	}
+}
+
+func TestFirstAbsent(t *testing.T) {
+	for _, at := range arrayTypes {
+		a := at.alloc()
+		if i, ok := FirstAbsent(a); i != 0 || !ok {
+			t.Errorf("%s: Empty FirstAbsent (%d, %v) != expected (0, true)", at.name, i, ok)
+		}
+		for k := 0; k < 256; k++ {
+			a.Put(uint8(k), k)
+			i, ok := FirstAbsent(a)
+			if k == 255 {
+				if ok {
+					t.Errorf("%s: Full FirstAbsent (%d, %v) != expected (0, false)", at.name, i, ok)
+				}
+			} else if int(i) != k+1 || !ok {
+				t.Errorf("%s: FirstAbsent (%d, %v) != expected (%d, true)", at.name, i, ok, k+1)
+			}
+		}
+		a.Put(70, nil)
+		a.Put(130, nil)
+		if i, ok := FirstAbsent(a); i != 70 || !ok {
+			t.Errorf("%s: FirstAbsent (%d, %v) != expected (70, true)", at.name, i, ok)
+		}
+	}
+}
+
+func TestSparseishVectorCopy(t *testing.T) {
+	const length = 5*blockSize + 17
+	testData := generateTestData(*dataSeed, 600, length)
+	allocs := append([]arrayType(nil), arrayTypes...)
+	allocs = append(allocs, arrayType{"ValidatingArray", func() Sparse256Array {
+		return &ValidatingArray{&BitmapArray{}}
+	}})
+	for _, at := range allocs {
+		v := NewSparseishVector(length, at.alloc)
+		for _, k := range testData {
+			v.Put(k, k)
+		}
+		v.blocks[3] = nil
+		checksum := v.Checksum()
+
+		c := v.Copy()
+		if !c.Equal(v) {
+			t.Fatalf("%s: Copy not equal to original", at.name)
+		}
+		if reflect.TypeOf(c.blocks[0]) != reflect.TypeOf(v.blocks[0]) || c.blocks[3] != nil {
+			t.Errorf("%s: Copy block types (%T, %T) != expected (%T, nil)",
+				at.name, c.blocks[0], c.blocks[3], v.blocks[0])
+		}
+
+		// Mutate every block of the copy, then the original.
+		for i := 0; i < length; i += 7 {
+			if c.Get(i) != nil {
+				c.Put(i, nil)
+			} else {
+				c.Put(i, "copy")
+			}
+		}
+		if v.Checksum() != checksum {
+			t.Errorf("%s: Modifying the copy changed the original", at.name)
+		}
+		copyChecksum := c.Checksum()
+		v.ClearRange(0, length/2)
+		v.Put(length-1, "original")
+		if c.Checksum() != copyChecksum {
+			t.Errorf("%s: Modifying the original changed the copy", at.name)
+		}
+	}
+}
+
+func TestSparseishVectorRangeFrom(t *testing.T) {
+	const length = 5*blockSize + 17
+	testData := generateTestData(*dataSeed, 300, length)
+	for _, at := range arrayTypes {
+		v := NewSparseishVector(length, at.alloc)
+		for _, k := range testData {
+			v.Put(k, k)
+		}
+		v.Put(blockSize-1, "last")
+		v.Put(blockSize, "first")
+		v.blocks[3] = nil
+		var all []int
+		v.Range(func(i int, _ interface{}) bool {
+			all = append(all, i)
+			return true
+		})
+
+		// Paginate through the vector, resuming after the last index of each
+		// page, so pages cross block boundaries.
+		for _, pageSize := range []int{1, 7, 100} {
+			var got []int
+			next := 0
+			for {
+				n := 0
+				v.RangeFrom(next, func(i int, val interface{}) bool {
+					if val != v.Get(i) {
+						t.Errorf("%s: RangeFrom value at %d %v != expected %v", at.name, i, val, v.Get(i))
+					}
+					got = append(got, i)
+					next = i + 1
+					n++
+					return n < pageSize
+				})
+				if n < pageSize {
+					break
+				}
+			}
+			if !reflect.DeepEqual(got, all) {
+				t.Errorf("%s: Paginated by %d %v != expected %v", at.name, pageSize, got, all)
+			}
+		}
+
+		for _, start := range []int{-1, 0, blockSize - 1, blockSize, blockSize + 1, 3*blockSize + 5, length} {
+			var expected, got []int
+			for _, i := range all {
+				if i >= start {
+					expected = append(expected, i)
+				}
+			}
+			v.RangeFrom(start, func(i int, _ interface{}) bool {
+				got = append(got, i)
+				return true
+			})
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("%s: RangeFrom(%d) %v != expected %v", at.name, start, got, expected)
+			}
+		}
+	}
+}
+
+func TestSparseishVectorChecksum(t *testing.T) {
+	const length = 4 * blockSize
+	testData := generateTestData(*dataSeed, 200, length)
+
+	rng := rand.New(rand.NewSource(*dataSeed))
+	var want uint64
+	for n, at := range arrayTypes {
+		// Insert in a different order for each array type. The checksum should
+		// only depend on the contents.
+		v := NewSparseishVector(length, at.alloc)
+		for _, i := range rng.Perm(len(testData)) {
+			k := testData[i]
+			v.Put(k, k)
+		}
+		sum := v.Checksum()
+		if n == 0 {
+			want = sum
+		} else if sum != want {
+			t.Errorf("%s: Checksum %x != expected %x", at.name, sum, want)
+		}
+
+		k := testData[0]
+		v.Put(k, k+1)
+		if v.Checksum() == want {
+			t.Errorf("%s: Checksum unchanged after modifying value at %d", at.name, k)
+		}
+		v.Put(k, k)
+		if v.Checksum() != want {
+			t.Errorf("%s: Checksum not restored after reverting value at %d", at.name, k)
+		}
+	}
+}
+
+// rangeCountingArray counts calls to Range on the wrapped array.
+type rangeCountingArray struct {
+	Sparse256Array
+	ranges *int
+}
+
+func (a *rangeCountingArray) Range(f func(i uint8, v interface{}) bool) {
+	*a.ranges++
+	a.Sparse256Array.Range(f)
+}
+
+func TestSparseishVectorIsEmpty(t *testing.T) {
+	const length = 4 * blockSize
+	for _, at := range arrayTypes {
+		v := NewSparseishVector(length, at.alloc)
+		if !v.IsEmpty() {
+			t.Errorf("%s: New vector not empty", at.name)
+		}
+		v.Put(length-1, 1)
+		if v.IsEmpty() {
+			t.Errorf("%s: Vector empty after Put", at.name)
+		}
+		v.Clear()
+		if !v.IsEmpty() {
+			t.Errorf("%s: Cleared vector not empty", at.name)
+		}
+	}
+
+	ranges := 0
+	v := NewSparseishVector(length, func() Sparse256Array {
+		return &rangeCountingArray{Sparse256Array: &SplitBinaryArray{}, ranges: &ranges}
+	})
+	v.Put(blockSize, 1)
+	if v.IsEmpty() {
+		t.Errorf("Vector empty after Put")
+	}
+	if ranges != 2 {
+		t.Errorf("IsEmpty scanned %d blocks != expected 2", ranges)
+	}
+}
+
+func TestMergeN(t *testing.T) {
+	const length = 4 * blockSize
+	lengths := []int{length, length / 2, length + 10}
+	refs := make([]map[int]interface{}, len(lengths))
+	vectors := make([]*SparseishVector, len(lengths))
+	for n, l := range lengths {
+		at := arrayTypes[n%len(arrayTypes)]
+		vectors[n] = NewSparseishVector(l, at.alloc)
+		refs[n] = make(map[int]interface{})
+		for _, k := range generateTestData(*dataSeed+int64(n), 100, l) {
+			vectors[n].Put(k, n*length+k)
+			refs[n][k] = n*length + k
+		}
+	}
+	// Guarantee some overlap between all vectors.
+	for n := range vectors {
+		vectors[n].Put(7, n)
+		refs[n][7] = n
+	}
+
+	last := -1
+	seen := 0
+	MergeN(vectors, func(i int, values []interface{}) {
+		if i <= last {
+			t.Errorf("Index %d not after %d", i, last)
+		}
+		last = i
+		seen++
+		present := false
+		for n, v := range values {
+			if v != refs[n][i] {
+				t.Errorf("Value %d at %d %v != expected %v", n, i, v, refs[n][i])
+			}
+			present = present || v != nil
+		}
+		if !present {
+			t.Errorf("Index %d not present in any vector", i)
+		}
+	})
+
+	union := make(map[int]bool)
+	for _, ref := range refs {
+		for k := range ref {
+			union[k] = true
+		}
+	}
+	if seen != len(union) {
+		t.Errorf("Merged %d indices != expected %d", seen, len(union))
+	}
+}
+
+func TestSetArray(t *testing.T) {
+	rng := rand.New(rand.NewSource(*dataSeed))
+	var a SetArray
+	ref := make(map[uint8]bool)
+	for n := 0; n < 2000; n++ {
+		i := uint8(rng.Intn(256))
+		switch rng.Intn(3) {
+		case 0:
+			a.Add(i)
+			ref[i] = true
+		case 1:
+			a.Delete(i)
+			delete(ref, i)
+		case 2:
+			a.Put(i, n)
+			ref[i] = true
+		}
+	}
+	for i := 0; i < 256; i++ {
+		if a.Contains(uint8(i)) != ref[uint8(i)] {
+			t.Errorf("Contains(%d) %v != expected %v", i, a.Contains(uint8(i)), ref[uint8(i)])
+		}
+		if (a.Get(uint8(i)) != nil) != ref[uint8(i)] {
+			t.Errorf("Get(%d) %v, expected present %v", i, a.Get(uint8(i)), ref[uint8(i)])
+		}
+	}
+	count := 0
+	a.Range(func(i uint8, v interface{}) bool {
+		if !ref[i] || v != true {
+			t.Errorf("Range yielded (%d, %v) not in set", i, v)
+		}
+		count++
+		return true
+	})
+	if count != len(ref) {
+		t.Errorf("Range count %d != expected %d", count, len(ref))
+	}
+}
+
+func TestRecommendArrayType(t *testing.T) {
+	for _, fill := range []int{0, 1, 2} {
+		if got := RecommendArrayType(fill); got != "BinaryArray" {
+			t.Errorf("RecommendArrayType(%d) %s != expected BinaryArray", fill, got)
+		}
+	}
+	for _, fill := range []int{3, 4, 16, 128, 256} {
+		if got := RecommendArrayType(fill); got != "BitmapArray" {
+			t.Errorf("RecommendArrayType(%d) %s != expected BitmapArray", fill, got)
+		}
+	}
+	for _, fill := range []int{0, 1, 16, 256} {
+		name := RecommendArrayType(fill)
+		found := false
+		for _, at := range arrayTypes {
+			found = found || at.name == name
+		}
+		if !found {
+			t.Errorf("RecommendArrayType(%d) %s not in arrayTypes", fill, name)
+		}
+	}
+}
+
+func TestSplitBinaryArrayGrowth(t *testing.T) {
+	var a SplitBinaryArray
+	ref := make(map[uint8]interface{})
+	for n := 0; n < 5000; n++ {
+		i := uint8(rand.Intn(256))
+		// Bias towards inserts so that the array fills up.
+		if rand.Intn(3) == 0 {
+			a.Put(i, nil)
+			delete(ref, i)
+		} else {
+			a.Put(i, n)
+			ref[i] = n
+		}
+		if len(a.indexes) != len(a.values) || len(a.indexes) != len(ref) {
+			t.Fatalf("Lengths (%d, %d) != expected %d", len(a.indexes), len(a.values), len(ref))
+		}
+		if cap(a.indexes) != cap(a.values) {
+			t.Fatalf("Capacities (%d, %d) not equal", cap(a.indexes), cap(a.values))
+		}
+		if !sort.SliceIsSorted(a.indexes, func(x, y int) bool { return a.indexes[x] < a.indexes[y] }) {
+			t.Fatalf("Indexes not sorted: %v", a.indexes)
+		}
+	}
+	checkArraysEqual(t, "SplitBinaryArray", &MapArray{m: ref}, &a)
+}
+
+func TestPutR(t *testing.T) {
+	type putRArray interface {
+		Sparse256Array
+		PutR(i uint8, v interface{}) bool
+	}
+	arrays := []struct {
+		name string
+		a    putRArray
+	}{
+		{"BinaryArray", &BinaryArray{}},
+		{"SplitBinaryArray", &SplitBinaryArray{}},
+		{"BitmapArray", &BitmapArray{}},
+	}
+	for _, c := range arrays {
+		if !c.a.PutR(10, 1) {
+			t.Errorf("%s: First Put didn't reallocate", c.name)
+		}
+		for n := 0; n < 10; n++ {
+			if c.a.PutR(10, n) {
+				t.Errorf("%s: Overwrite %d reallocated", c.name, n)
+			}
+		}
+		reallocs := 0
+		for i := 0; i < 256; i++ {
+			if c.a.PutR(uint8(i), i) {
+				reallocs++
+			}
+		}
+		// Slices grow geometrically, so reallocation is infrequent.
+		if reallocs == 0 || reallocs > 16 {
+			t.Errorf("%s: %d reallocations filling the block", c.name, reallocs)
+		}
+		for i := 0; i < 256; i++ {
+			if c.a.PutR(uint8(i), -i) {
+				t.Errorf("%s: Overwrite at %d reallocated", c.name, i)
+			}
+		}
+		if c.a.PutR(10, nil) {
+			t.Errorf("%s: Delete reallocated", c.name)
+		}
+	}
+}
+
+func TestGenerateTestData(t *testing.T) {
+	a := generateTestData(42, 1000, 100)
+	b := generateTestData(42, 1000, 100)
+	c := generateTestData(43, 1000, 100)
+	same := true
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("Data at %d differs with the same seed: %d != %d", i, a[i], b[i])
+		}
+		if a[i] < 0 || a[i] >= 100 {
+			t.Errorf("Data at %d %d out of range", i, a[i])
+		}
+		same = same && a[i] == c[i]
+	}
+	if same {
+		t.Errorf("Different seeds generated the same data")
+	}
+}
+
+type rangeValuesArray interface {
+	Sparse256Array
+	RangeValues(f func(v interface{}) bool)
+}
+
+func TestBitmapArrayRangeMutable(t *testing.T) {
+	var a BitmapArray
+	ref := make(map[uint8]interface{})
+	for _, k := range rand.Perm(256)[:200] {
+		a.Put(uint8(k), k)
+		ref[uint8(k)] = k
+	}
+
+	// Delete every other element, and increment the survivors.
+	n := 0
+	a.RangeMutable(func(i uint8, v interface{}) (interface{}, bool) {
+		if v != ref[i] {
+			t.Errorf("RangeMutable value at %d %v != expected %v", i, v, ref[i])
+		}
+		n++
+		if n%2 == 0 {
+			delete(ref, i)
+			return nil, false
+		}
+		ref[i] = v.(int) + 1
+		return ref[i], true
+	})
+	if n != 200 {
+		t.Errorf("RangeMutable visited %d elements != expected 200", n)
+	}
+	if a.Len() != len(ref) || len(a.values) != len(ref) {
+		t.Errorf("Len %d (%d values) != expected %d", a.Len(), len(a.values), len(ref))
+	}
+	for i := 0; i < 256; i++ {
+		if a.Get(uint8(i)) != ref[uint8(i)] {
+			t.Errorf("Get(%d) %v != expected %v", i, a.Get(uint8(i)), ref[uint8(i)])
+		}
+	}
+}
+
+func TestBitmapArrayGetManyFound(t *testing.T) {
+	var a BitmapArray
+	for _, k := range rand.Perm(256)[:100] {
+		a.Put(uint8(k), k)
+	}
+	indices := make([]uint8, 300)
+	for n := range indices {
+		indices[n] = uint8(rand.Intn(256))
+	}
+	// Put(i, nil) deletes, so there are no present-nil elements to find.
+	a.Put(indices[0], nil)
+
+	values, found := a.GetManyFound(indices)
+	if len(values) != len(indices) || len(found) != len(indices) {
+		t.Fatalf("Result lengths (%d, %d) != expected %d", len(values), len(found), len(indices))
+	}
+	for n, i := range indices {
+		v := a.Get(i)
+		if values[n] != v || found[n] != (v != nil) {
+			t.Errorf("GetManyFound index %d (%v, %v) != expected (%v, %v)", i, values[n], found[n], v, v != nil)
+		}
+	}
+}
+
+func TestBitmapArrayGetRange(t *testing.T) {
+	var a BitmapArray
+	// A dense run, so some windows take the fast path.
+	for k := 32; k < 96; k++ {
+		a.Put(uint8(k), k)
+	}
+	for _, k := range rand.Perm(256)[:80] {
+		a.Put(uint8(k), k)
+	}
+	for _, w := range []struct{ start, n int }{
+		{0, 0}, {0, 256}, {32, 64}, {40, 10}, {0, 50}, {200, 56}, {255, 1}, {95, 2},
+	} {
+		dst := make([]interface{}, w.n)
+		for n := range dst {
+			dst[n] = "stale"
+		}
+		a.GetRange(uint8(w.start), dst)
+		for n, v := range dst {
+			if e := a.Get(uint8(w.start + n)); v != e {
+				t.Errorf("GetRange(%d, %d) index %d %v != expected %v", w.start, w.n, w.start+n, v, e)
+			}
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("GetRange past the end of the array didn't panic")
+		}
+	}()
+	a.GetRange(200, make([]interface{}, 57))
+}
+
+func BenchmarkBitmapArrayGetRange(b *testing.B) {
+	const start, size = 64, 128
+	var a BitmapArray
+	for k := 0; k < 256; k++ {
+		a.Put(uint8(k), testValues[k])
+	}
+	dst := make([]interface{}, size)
+
+	b.Run("GetRange", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			a.GetRange(start, dst)
+		}
+	})
+	b.Run("Get", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for n := range dst {
+				dst[n] = a.Get(uint8(start + n))
+			}
+		}
+	})
+}
+
+func TestRangeValues(t *testing.T) {
+	rng := rand.New(rand.NewSource(*dataSeed))
+	for _, a := range []rangeValuesArray{&SplitBinaryArray{}, &BitmapArray{}} {
+		for _, k := range rng.Perm(256)[:100] {
+			a.Put(uint8(k), k)
+		}
+		var want, got []interface{}
+		a.Range(func(_ uint8, v interface{}) bool {
+			want = append(want, v)
+			return true
+		})
+		a.RangeValues(func(v interface{}) bool {
+			got = append(got, v)
+			return true
+		})
+		if len(got) != len(want) {
+			t.Fatalf("%T: RangeValues yielded %d values != expected %d", a, len(got), len(want))
+		}
+		for n := range got {
+			if got[n] != want[n] {
+				t.Errorf("%T: RangeValues value %d %v != expected %v", a, n, got[n], want[n])
+			}
+		}
+
+		count := 0
+		a.RangeValues(func(interface{}) bool {
+			count++
+			return count < 10
+		})
+		if count != 10 {
+			t.Errorf("%T: RangeValues didn't stop, %d values", a, count)
+		}
+	}
+}
+
+func BenchmarkRangeValues(b *testing.B) {
+	rng := rand.New(rand.NewSource(*dataSeed))
+	for _, a := range []rangeValuesArray{&SplitBinaryArray{}, &BitmapArray{}} {
+		for _, k := range rng.Perm(256)[:128] {
+			a.Put(uint8(k), k)
+		}
+		name := strings.TrimPrefix(fmt.Sprintf("%T", a), "*vectest.")
+		b.Run(name+"/Range", func(b *testing.B) {
+			sum := 0
+			for i := 0; i < b.N; i++ {
+				a.Range(func(_ uint8, v interface{}) bool {
+					sum += v.(int)
+					return true
+				})
+			}
+		})
+		b.Run(name+"/RangeValues", func(b *testing.B) {
+			sum := 0
+			for i := 0; i < b.N; i++ {
+				a.RangeValues(func(v interface{}) bool {
+					sum += v.(int)
+					return true
+				})
+			}
+		})
+	}
+}
+
+func TestSparseishVectorReserve(t *testing.T) {
+	const length = 4 * blockSize
+	testData := generateTestData(*dataSeed, 500, length)
+	for _, at := range arrayTypes {
+		v := NewSparseishVector(length, at.alloc)
+		ref := make(map[int]interface{})
+		for _, k := range testData[:100] {
+			v.Put(k, k)
+			ref[k] = k
+		}
+		// Reserving on a partially filled vector must keep its contents.
+		v.Reserve(128)
+		for _, k := range testData[100:] {
+			v.Put(k, -k)
+			ref[k] = -k
+		}
+		for i := 0; i < length; i++ {
+			if v.Get(i) != ref[i] {
+				t.Errorf("%s: Get(%d) %v != expected %v", at.name, i, v.Get(i), ref[i])
+			}
+		}
+	}
+}
+
+func BenchmarkVectorReserve(b *testing.B) {
+	const (
+		length   = 1 << 16
+		perBlock = blockSize / 2
+	)
+	testData := generateTestData(*dataSeed, length/2, length)
+	sort.Ints(testData)
+	for _, at := range benchArrayTypes() {
+		for _, reserve := range []bool{false, true} {
+			name := at.name + "/NoReserve"
+			if reserve {
+				name = at.name + "/Reserve"
+			}
+			b.Run(name, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					v := NewSparseishVector(length, at.alloc)
+					if reserve {
+						v.Reserve(perBlock)
+					}
+					for _, k := range testData {
+						v.Put(k, k)
+					}
 				}
-				b.ResetTimer()
+			})
+		}
+	}
+}
 
-				for i := 0; i < b.N; i++ {
-					k := testData[i%fillItems]
-					v.Get(k)
+func TestSparseishVectorAt(t *testing.T) {
+	const length = blockSize + 10
+	for _, at := range arrayTypes {
+		v := NewSparseishVector(length, at.alloc)
+		v.Put(0, 1)
+		v.Put(length-1, 2)
+		v.Put(5, 3)
+		v.Put(5, nil)
+
+		cases := []struct {
+			i   int
+			val interface{}
+			ok  bool
+		}{
+			{0, 1, true},
+			{length - 1, 2, true},
+			{1, nil, false},
+			{5, nil, false},
+			{-1, nil, false},
+			{length, nil, false},
+			{2 * blockSize, nil, false},
+		}
+		for _, c := range cases {
+			val, ok := v.At(c.i)
+			if val != c.val || ok != c.ok {
+				t.Errorf("%s: At(%d) (%v, %v) != expected (%v, %v)", at.name, c.i, val, ok, c.val, c.ok)
+			}
+		}
+	}
+}
+
+func TestSparseishVectorClearRetain(t *testing.T) {
+	const length = 4 * blockSize
+	testData := generateTestData(*dataSeed, 500, length)
+	for _, at := range arrayTypes {
+		v := NewSparseishVector(length, at.alloc)
+		for _, k := range testData {
+			v.Put(k, k)
+		}
+		v.ClearRetain()
+		if !v.IsEmpty() {
+			t.Errorf("%s: Vector not empty after ClearRetain", at.name)
+		}
+		for _, k := range testData[:100] {
+			v.Put(k, -k)
+		}
+		for _, k := range testData[:100] {
+			if v.Get(k) != -k {
+				t.Errorf("%s: Get(%d) %v != expected %d", at.name, k, v.Get(k), -k)
+			}
+		}
+	}
+}
+
+func TestSparseishVectorN(t *testing.T) {
+	const length = 100000
+	testData := generateTestData(*dataSeed, 2000, length)
+	for _, blockBits := range []int{8, 12, 16} {
+		for _, at := range arrayTypes {
+			v := NewSparseishVector(length, at.alloc)
+			vn := NewSparseishVectorN(length, blockBits, at.alloc)
+			if want := (length + 1<<blockBits - 1) >> blockBits; len(vn.blocks) != want {
+				t.Errorf("%s/%d: %d blocks != expected %d", at.name, blockBits, len(vn.blocks), want)
+			}
+			for n, k := range testData {
+				var val interface{} = n
+				if n%3 == 0 {
+					val = nil
+				}
+				v.Put(k, val)
+				vn.Put(k, val)
+			}
+			for i := 0; i < length; i++ {
+				if v.Get(i) != vn.Get(i) {
+					t.Errorf("%s/%d: Get(%d) %v != expected %v", at.name, blockBits, i, vn.Get(i), v.Get(i))
+				}
+			}
+		}
+	}
+
+	// Sparse data leaves most blocks unallocated, so the blocks slice is
+	// most of the overhead, and shrinks with larger blocks.
+	const sparseLength = 1 << 24
+	for _, blockBits := range []int{8, 16} {
+		vn := NewSparseishVectorN(sparseLength, blockBits, arrayTypes[0].alloc)
+		vn.Put(5, 5)
+		vn.Put(sparseLength-1, 1)
+		subBlocks := 0
+		for _, wb := range vn.blocks {
+			if wb != nil {
+				subBlocks += len(wb.sub)
+			}
+		}
+		overhead := len(vn.blocks)*int(unsafe.Sizeof(vn.blocks[0])) +
+			subBlocks*int(unsafe.Sizeof(Sparse256Array(nil)))
+		t.Logf("blockBits %d: %d blocks, %d bytes of block pointers", blockBits, len(vn.blocks), overhead)
+		if vn.Get(5) != 5 || vn.Get(sparseLength-1) != 1 || vn.Get(6) != nil {
+			t.Errorf("blockBits %d: Get (%v, %v, %v) != expected (5, 1, nil)",
+				blockBits, vn.Get(5), vn.Get(sparseLength-1), vn.Get(6))
+		}
+		if blockBits == 16 && overhead*16 > sparseLength>>8*int(unsafe.Sizeof(Sparse256Array(nil))) {
+			t.Errorf("blockBits 16: %d bytes of block pointers, not much less than a SparseishVector", overhead)
+		}
+	}
+
+	for _, blockBits := range []int{0, 7, 17} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("NewSparseishVectorN with blockBits %d didn't panic", blockBits)
+				}
+			}()
+			NewSparseishVectorN(length, blockBits, arrayTypes[0].alloc)
+		}()
+	}
+}
+
+func TestSparseishVectorSample(t *testing.T) {
+	const (
+		length = 64 * blockSize
+		rate   = 0.1
+		trials = 50
+	)
+	testData := generateTestData(*dataSeed, length/2, length)
+	for _, at := range arrayTypes {
+		v := NewSparseishVector(length, at.alloc)
+		for _, k := range testData {
+			v.Put(k, k)
+		}
+		present := 0
+		v.Range(func(int, interface{}) bool {
+			present++
+			return true
+		})
+
+		rng := rand.New(rand.NewSource(*dataSeed))
+		total := 0
+		for n := 0; n < trials; n++ {
+			last := -1
+			v.Sample(rate, rng, func(i int, val interface{}) {
+				if i <= last {
+					t.Errorf("%s: Sampled index %d not after %d", at.name, i, last)
+				}
+				if val != i {
+					t.Errorf("%s: Sampled value at %d %v != expected %d", at.name, i, val, i)
 				}
+				last = i
+				total++
 			})
 		}
+		// The total is Binomial(trials*present, rate), so allow 5 standard
+		// deviations.
+		mean := rate * float64(trials*present)
+		stddev := math.Sqrt(mean * (1 - rate))
+		if math.Abs(float64(total)-mean) > 5*stddev {
+			t.Errorf("%s: Sampled %d elements, expected %.0f +/- %.0f", at.name, total, mean, 5*stddev)
+		}
+
+		// The same seed gives the same sample.
+		var a, b []int
+		v.Sample(rate, rand.New(rand.NewSource(1)), func(i int, _ interface{}) { a = append(a, i) })
+		v.Sample(rate, rand.New(rand.NewSource(1)), func(i int, _ interface{}) { b = append(b, i) })
+		if len(a) != len(b) {
+			t.Fatalf("%s: Samples with the same seed have lengths %d and %d", at.name, len(a), len(b))
+		}
+		for n := range a {
+			if a[n] != b[n] {
+				t.Errorf("%s: Samples with the same seed differ at %d: %d != %d", at.name, n, a[n], b[n])
+			}
+		}
+
+		all := 0
+		v.Sample(1, rng, func(int, interface{}) { all++ })
+		if all != present {
+			t.Errorf("%s: Sample with rate 1 yielded %d != expected %d", at.name, all, present)
+		}
 	}
 }
 
-func BenchmarkArray256Worse(b *testing.B) {
-	var a BitmapArray
-	for i := 0; i < 256; i++ {
-		a.Put(uint8(i), 7)
+type deleteManyArray interface {
+	Sparse256Array
+	DeleteMany(indices []uint8) int
+}
+
+func TestDeleteMany(t *testing.T) {
+	rng := rand.New(rand.NewSource(*dataSeed))
+	for _, at := range arrayTypes {
+		a, ok := at.alloc().(deleteManyArray)
+		if !ok {
+			continue
+		}
+		ref := at.alloc()
+		for _, k := range rng.Perm(256)[:200] {
+			a.Put(uint8(k), k)
+			ref.Put(uint8(k), k)
+		}
+		// Include absent and duplicate indices.
+		var indices []uint8
+		for _, k := range rng.Perm(256)[:100] {
+			indices = append(indices, uint8(k))
+		}
+		indices = append(indices, indices[:10]...)
+
+		want := 0
+		for _, i := range indices {
+			if ref.Get(i) != nil {
+				ref.Put(i, nil)
+				want++
+			}
+		}
+		if got := a.DeleteMany(indices); got != want {
+			t.Errorf("%s: DeleteMany returned %d != expected %d", at.name, got, want)
+		}
+		checkArraysEqual(t, at.name, ref, a)
+		if a.Len() != ref.Len() {
+			t.Errorf("%s: Len %d != expected %d", at.name, a.Len(), ref.Len())
+		}
+	}
+}
+
+func BenchmarkDeleteMany(b *testing.B) {
+	const fill = 256 * 90 / 100
+	keys := rand.New(rand.NewSource(*dataSeed)).Perm(256)[:fill]
+	deletes := make([]uint8, 64)
+	for n, k := range keys[:len(deletes)] {
+		deletes[n] = uint8(k)
 	}
 
-	for i := 0; i < b.N; i++ {
-		a.Put(0, nil)
-		a.Put(0, 1)
+	for _, at := range benchArrayTypes() {
+		if _, ok := at.alloc().(deleteManyArray); !ok {
+			continue
+		}
+		for _, batch := range []bool{false, true} {
+			name := at.name + "/Loop"
+			if batch {
+				name = at.name + "/DeleteMany"
+			}
+			b.Run(name, func(b *testing.B) {
+				a := at.alloc().(deleteManyArray)
+				for _, k := range keys {
+					a.Put(uint8(k), testValues[k])
+				}
+				// Stopping the timer to refill is very expensive, so the time
+				// includes putting the deleted elements back.
+				for i := 0; i < b.N; i++ {
+					if batch {
+						a.DeleteMany(deletes)
+					} else {
+						for _, k := range deletes {
+							a.Put(k, nil)
+						}
+					}
+					for _, k := range deletes {
+						a.Put(k, testValues[k])
+					}
+				}
+			})
+		}
 	}
 }
 
-func BenchmarkArray256Mid(b *testing.B) {
-	var a BitmapArray
-	for i := 0; i < 256; i++ {
-		a.Put(uint8(i), 7)
+func TestKind(t *testing.T) {
+	for _, at := range arrayTypes {
+		if k := at.alloc().Kind(); k != at.name {
+			t.Errorf("%s: Kind %q != expected %q", at.name, k, at.name)
+		}
+	}
+	for _, tc := range []struct {
+		a    Sparse256Array
+		kind string
+	}{
+		{&SetArray{}, "SetArray"},
+		{&LazyBitmapArray{}, "LazyBitmapArray"},
+		{&PackedBitmapArray[interface{}]{}, "PackedBitmapArray"},
+		{&ClockArray{}, "ClockArray"},
+		{&ProbedBinaryArray{}, "ProbedBinaryArray"},
+		// Wrappers report the kind of the wrapped array.
+		{&rangeCountingArray{Sparse256Array: &BinaryArray{}}, "BinaryArray"},
+		{NewColdBlock(func() Sparse256Array { return &BitmapArray{} }), "BitmapArray"},
+	} {
+		if k := tc.a.Kind(); k != tc.kind {
+			t.Errorf("Kind %q != expected %q", k, tc.kind)
+		}
 	}
 
-	for i := 0; i < b.N; i++ {
-		a.Put(128, nil)
-		a.Put(128, 1)
+	c := NewColdBlock(func() Sparse256Array { return &SplitBinaryArray{} })
+	c.Put(3, 3)
+	c.Compress()
+	if k := c.Kind(); k != "SplitBinaryArray" || !c.IsCold() {
+		t.Errorf("Compressed ColdBlock (Kind %q, cold %v) != expected (SplitBinaryArray, true)", k, c.IsCold())
 	}
 }
 
-func BenchmarkArray256Best(b *testing.B) {
-	var a BitmapArray
-	for i := 0; i < 256; i++ {
-		a.Put(uint8(i), 7)
+func TestReduce(t *testing.T) {
+	const length = 20 * blockSize
+	testData := generateTestData(*dataSeed, 1000, length)
+	for _, at := range arrayTypes {
+		v := NewSparseishVector(length, at.alloc)
+		ref := make(map[int]int)
+		for _, k := range testData {
+			v.Put(k, k*3)
+			ref[k] = k * 3
+		}
+		expectedSum, expectedMax := 0, -1
+		for _, val := range ref {
+			expectedSum += val
+			if val > expectedMax {
+				expectedMax = val
+			}
+		}
+
+		sum := Reduce(v, 0, func(acc, _ int, val interface{}) int {
+			return acc + val.(int)
+		})
+		if sum != expectedSum {
+			t.Errorf("%s: Reduce sum %d != expected %d", at.name, sum, expectedSum)
+		}
+		max := Reduce(v, -1, func(acc, _ int, val interface{}) int {
+			if val.(int) > acc {
+				return val.(int)
+			}
+			return acc
+		})
+		if max != expectedMax {
+			t.Errorf("%s: Reduce max %d != expected %d", at.name, max, expectedMax)
+		}
+
+		indices := Reduce(v, []int(nil), func(acc []int, i int, _ interface{}) []int {
+			return append(acc, i)
+		})
+		if len(indices) != len(ref) {
+			t.Errorf("%s: Reduce visited %d elements != expected %d", at.name, len(indices), len(ref))
+		}
+		for n := 1; n < len(indices); n++ {
+			if indices[n] <= indices[n-1] {
+				t.Errorf("%s: Reduce index %d after %d, not ascending", at.name, indices[n], indices[n-1])
+			}
+		}
 	}
+}
 
-	for i := 0; i < b.N; i++ {
-		a.Put(255, nil)
-		a.Put(255, 1)
+func TestIterateDifference(t *testing.T) {
+	const length = 8 * blockSize
+	for _, at := range arrayTypes {
+		// b is shorter, so a's last blocks have no counterpart, and both are
+		// lazily allocated, so some blocks are only present in one vector.
+		a := newLazySparseishVector(length, at.alloc)
+		b := newLazySparseishVector(length-3*blockSize, at.alloc)
+		refA, refB := make(map[int]interface{}), make(map[int]bool)
+		for _, k := range generateTestData(*dataSeed, 300, 5*blockSize) {
+			if k>>blockBits != 1 {
+				a.Put(k, k)
+				refA[k] = k
+			}
+		}
+		for _, k := range generateTestData(*dataSeed+1, 300, b.Len()) {
+			if k>>blockBits != 2 {
+				b.Put(k, -k)
+				refB[k] = true
+			}
+		}
+		a.Put(length-1, "end")
+		refA[length-1] = "end"
+		// Some shared indices.
+		for k := 0; k < 50; k++ {
+			a.Put(k, k)
+			b.Put(k, k)
+			refA[k], refB[k] = k, true
+		}
+
+		expected := 0
+		for k := range refA {
+			if !refB[k] {
+				expected++
+			}
+		}
+		last, seen := -1, 0
+		IterateDifference(a, b, func(i int, v interface{}) {
+			if i <= last {
+				t.Errorf("%s: Index %d not after %d", at.name, i, last)
+			}
+			last = i
+			seen++
+			if refB[i] {
+				t.Errorf("%s: Index %d present in b", at.name, i)
+			} else if v != refA[i] {
+				t.Errorf("%s: Value at %d %v != expected %v", at.name, i, v, refA[i])
+			}
+		})
+		if seen != expected {
+			t.Errorf("%s: Difference has %d elements != expected %d", at.name, seen, expected)
+		}
 	}
 }
 
-func BenchmarkArray256Assign(b *testing.B) {
-	var a BitmapArray
+func TestGetOrCompute(t *testing.T) {
+	for _, at := range arrayTypes {
+		v := newLazySparseishVector(4*blockSize, at.alloc)
+		v.Put(5, "existing")
+		loads := 0
+		load := func(val interface{}) func() interface{} {
+			return func() interface{} {
+				loads++
+				return val
+			}
+		}
 
-	for i := 0; i < b.N; i++ {
-		a.Put(uint8(i), i)
+		if got := v.GetOrCompute(5, load("loaded")); got != "existing" || loads != 0 {
+			t.Errorf("%s: Hit (%v, %d loads) != expected (existing, 0)", at.name, got, loads)
+		}
+		// A miss in an unallocated block.
+		if got := v.GetOrCompute(700, load(700)); got != 700 || loads != 1 {
+			t.Errorf("%s: Miss (%v, %d loads) != expected (700, 1)", at.name, got, loads)
+		}
+		if got := v.GetOrCompute(700, load(701)); got != 700 || loads != 1 {
+			t.Errorf("%s: Cached (%v, %d loads) != expected (700, 1)", at.name, got, loads)
+		}
+		if v.Get(700) != 700 {
+			t.Errorf("%s: Get(700) %v != expected 700", at.name, v.Get(700))
+		}
+
+		// A nil load isn't stored, so the next call loads again.
+		v.GetOrCompute(300, load(nil))
+		if v.blocks[1] != nil {
+			t.Errorf("%s: Block allocated for a nil load", at.name)
+		}
+		v.GetOrCompute(300, load(300))
+		if loads != 3 || v.Get(300) != 300 {
+			t.Errorf("%s: After nil load (%d loads, Get %v) != expected (3, 300)", at.name, loads, v.Get(300))
+		}
 	}
 }
 
-func BenchmarkArray256Get(b *testing.B) {
-	var a BitmapArray
-	for i := 0; i < 16; i++ {
-		a.Put(uint8(i), i)
+func TestSweep(t *testing.T) {
+	const numBlocks = 10
+	for _, at := range arrayTypes {
+		v := NewSparseishVector(numBlocks*blockSize, at.alloc)
+		for bi := 0; bi < numBlocks; bi++ {
+			for i := 0; i < 5; i++ {
+				v.Put(bi*blockSize+i*7, i+1)
+			}
+		}
+		// Empty blocks 2, 5 and 9, and partially empty block 3.
+		emptied := map[int]bool{2: true, 5: true, 9: true}
+		for bi := range emptied {
+			for i := 0; i < 5; i++ {
+				v.Put(bi*blockSize+i*7, nil)
+			}
+		}
+		v.Put(3*blockSize, nil)
+		count := v.Count()
+
+		if freed := v.Sweep(); freed != len(emptied) {
+			t.Errorf("%s: Sweep freed %d blocks != expected %d", at.name, freed, len(emptied))
+		}
+		for bi, b := range v.blocks {
+			if emptied[bi] != (b == nil) {
+				t.Errorf("%s: Block %d freed %v != expected %v", at.name, bi, b == nil, emptied[bi])
+			}
+		}
+		if v.Len() != numBlocks*blockSize || v.Count() != count {
+			t.Errorf("%s: After Sweep (len %d, count %d) != expected (%d, %d)",
+				at.name, v.Len(), v.Count(), numBlocks*blockSize, count)
+		}
+		if freed := v.Sweep(); freed != 0 {
+			t.Errorf("%s: Second Sweep freed %d blocks", at.name, freed)
+		}
+
+		// Freed blocks are reallocated on Put.
+		v.Put(5*blockSize+1, "again")
+		if v.Get(5*blockSize+1) != "again" {
+			t.Errorf("%s: Get after Put into freed block %v", at.name, v.Get(5*blockSize+1))
+		}
 	}
+}
 
-	for i := 0; i < b.N; i++ {
-		_ = a.Get(uint8(i))
+func TestUnion(t *testing.T) {
+	sum := func(av, bv interface{}) interface{} {
+		return av.(int) + bv.(int)
+	}
+	for _, at := range arrayTypes {
+		a, b := at.alloc(), at.alloc()
+		for i := 0; i < 100; i++ {
+			a.Put(uint8(i), i)
+		}
+		for i := 150; i < 200; i++ {
+			b.Put(uint8(i), i)
+		}
+
+		// Disjoint.
+		u := Union(a, b, sum)
+		if u.Len() != 150 {
+			t.Errorf("%s: Disjoint union Len %d != expected 150", at.name, u.Len())
+		}
+		for i := 0; i < 256; i++ {
+			var expected interface{}
+			if i < 100 || (i >= 150 && i < 200) {
+				expected = i
+			}
+			if u.Get(uint8(i)) != expected {
+				t.Errorf("%s: Disjoint Get(%d) %v != expected %v", at.name, i, u.Get(uint8(i)), expected)
+			}
+		}
+
+		// Overlapping, with a nil combine result dropping index 60.
+		for i := 50; i < 80; i++ {
+			b.Put(uint8(i), 1000)
+		}
+		u = Union(a, b, func(av, bv interface{}) interface{} {
+			if av == 60 {
+				return nil
+			}
+			return sum(av, bv)
+		})
+		if u.Len() != 149 {
+			t.Errorf("%s: Overlapping union Len %d != expected 149", at.name, u.Len())
+		}
+		for _, c := range []struct{ i, expected interface{} }{
+			{10, 10}, {50, 1050}, {79, 1079}, {60, nil}, {80, 80}, {150, 150}, {120, nil},
+		} {
+			if v := u.Get(uint8(c.i.(int))); v != c.expected {
+				t.Errorf("%s: Overlapping Get(%d) %v != expected %v", at.name, c.i, v, c.expected)
+			}
+		}
+
+		// Identical, keeping the first value.
+		u = Union(a, a, func(av, _ interface{}) interface{} {
+			return av
+		})
+		checkArraysEqual(t, at.name, a, u)
+		if a.Len() != 100 || b.Len() != 80 {
+			t.Errorf("%s: Inputs modified (len %d, %d)", at.name, a.Len(), b.Len())
+		}
 	}
 }
 
-func BenchmarkMap(b *testing.B) {
-	a := make(map[uint8]interface{})
-	for i := 1; i < 16; i++ {
-		a[uint8(i)] = i
+func TestContainsAll(t *testing.T) {
+	const length = 10*blockSize + 7
+	for _, at := range arrayTypes {
+		v := newLazySparseishVector(length, at.alloc)
+		for _, k := range generateTestData(*dataSeed, 800, length) {
+			v.Put(k, k)
+		}
+		probes := generateTestData(*dataSeed+1, 3000, length)
+		probes = append(probes, -1, length, length+blockSize, probes[0], probes[0])
+
+		found := v.ContainsAll(probes)
+		if len(found) != len(probes) {
+			t.Fatalf("%s: ContainsAll returned %d results != expected %d", at.name, len(found), len(probes))
+		}
+		for n, k := range probes {
+			if _, ok := v.At(k); found[n] != ok {
+				t.Errorf("%s: ContainsAll probe %d (index %d) %v != At %v", at.name, n, k, found[n], ok)
+			}
+		}
 	}
+}
 
-	for i := 0; i < b.N; i++ {
-		a[uint8(i)] = 1
-		delete(a, uint8(i))
+func TestFillRange(t *testing.T) {
+	const length = 6 * blockSize
+	for _, at := range arrayTypes {
+		for _, r := range [][2]int{{0, length}, {blockSize, 2 * blockSize}, {100, 900}, {300, 301}, {5, 5}} {
+			lo, hi := r[0], r[1]
+			v := newLazySparseishVector(length, at.alloc)
+			ref := make(map[int]interface{})
+			for _, k := range generateTestData(*dataSeed, 300, length) {
+				v.Put(k, k)
+				ref[k] = k
+			}
+			v.FillRange(lo, hi, "fill")
+			for i := lo; i < hi; i++ {
+				ref[i] = "fill"
+			}
+			for i := 0; i < length; i++ {
+				if got := v.Get(i); got != ref[i] {
+					t.Fatalf("%s: FillRange(%d, %d): Get(%d) %v != expected %v", at.name, lo, hi, i, got, ref[i])
+				}
+			}
+			if v.Count() != len(ref) {
+				t.Errorf("%s: FillRange(%d, %d): Count %d != expected %d", at.name, lo, hi, v.Count(), len(ref))
+			}
+
+			v.FillRange(lo, hi, nil)
+			for i := lo; i < hi; i++ {
+				if v.Get(i) != nil {
+					t.Fatalf("%s: FillRange(%d, %d, nil): Get(%d) %v != expected nil", at.name, lo, hi, i, v.Get(i))
+				}
+			}
+		}
 	}
 }
 
-func BenchmarkMapAssign(b *testing.B) {
-	a := make(map[uint8]interface{})
+func BenchmarkFillRange(b *testing.B) {
+	const length = 1 << 16
+	v := NewSparseishVector(length, func() Sparse256Array {
+		return &BitmapArray{}
+	})
+	b.Run("FillRange", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			v.Clear()
+			v.FillRange(0, length, 1)
+		}
+	})
+	b.Run("Put", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			v.Clear()
+			for j := 0; j < length; j++ {
+				v.Put(j, 1)
+			}
+		}
+	})
+}
 
-	for i := 0; i < b.N; i++ {
-		a[uint8(i)] = 1
+func TestArrayEdgeIndices(t *testing.T) {
+	types := append([]arrayType{
+		{"LazyBitmapArray", func() Sparse256Array { return &LazyBitmapArray{} }},
+		{"LazyBitmapArray/Compact", func() Sparse256Array { return &LazyBitmapArray{CompactThreshold: 1} }},
+		{"OpenAddrArray/MaxLoad", func() Sparse256Array { return NewOpenAddrArray(1) }},
+		{"PackedBitmapArray", func() Sparse256Array { return &PackedBitmapArray[interface{}]{} }},
+		{"ClockArray", func() Sparse256Array { return &ClockArray{} }},
+	}, arrayTypes...)
+	backgrounds := map[string][]int{
+		"Empty":  nil,
+		"Full":   rand.Perm(256),
+		"Middle": {1, 100, 128, 254},
+		"Sparse": rand.Perm(256)[:50],
+	}
+
+	for _, at := range types {
+		for bgName, bg := range backgrounds {
+			name := at.name + "/" + bgName
+			a := at.alloc()
+			ref := make(map[uint8]interface{})
+			put := func(i uint8, v interface{}) {
+				a.Put(i, v)
+				if v == nil {
+					delete(ref, i)
+				} else {
+					ref[i] = v
+				}
+				for j := 0; j < 256; j++ {
+					if got := a.Get(uint8(j)); got != ref[uint8(j)] {
+						t.Fatalf("%s: After Put(%d, %v): Get(%d) %v != expected %v", name, i, v, j, got, ref[uint8(j)])
+					}
+				}
+				last, count := -1, 0
+				a.Range(func(j uint8, v interface{}) bool {
+					if int(j) <= last || v != ref[j] {
+						t.Fatalf("%s: After Put(%d, %v): Range yielded (%d, %v) after %d", name, i, v, j, v, last)
+					}
+					last = int(j)
+					count++
+					return true
+				})
+				if a.Len() != len(ref) || count != len(ref) {
+					t.Fatalf("%s: After Put(%d, %v): Len %d, Range count %d != expected %d", name, i, v, a.Len(), count, len(ref))
+				}
+			}
+
+			for _, k := range bg {
+				put(uint8(k), k+1000)
+			}
+			for _, order := range [][2]uint8{{0, 255}, {255, 0}} {
+				for _, i := range order {
+					put(i, "insert")
+				}
+				for _, i := range order {
+					put(i, "overwrite")
+				}
+				for _, i := range order {
+					put(i, nil)
+				}
+				// Deleting an absent edge element is a no-op.
+				put(order[0], nil)
+			}
+		}
 	}
 }
 
-func BenchmarkMapGet(b *testing.B) {
-	a := make(map[uint8]interface{})
-	for i := 0; i < 16; i++ {
-		a[uint8(i)] = i
+func TestEqualityFuncs(t *testing.T) {
+	// Slices aren't comparable, so == on them panics.
+	sameLen := func(a, b interface{}) bool {
+		return len(a.([]int)) == len(b.([]int))
 	}
 
-	for i := 0; i < b.N; i++ {
-		_ = a[uint8(i)]
+	a := NewSparseishVector(2*blockSize, arrayTypes[0].alloc)
+	b := NewSparseishVector(2*blockSize, arrayTypes[1].alloc)
+	a.Put(3, []int{1, 2})
+	b.Put(3, []int{3, 4})
+	a.Put(300, []int{5})
+	b.Put(300, []int{5})
+	if !a.EqualFunc(b, sameLen) {
+		t.Errorf("EqualFunc with same-length comparator returned false")
+	}
+	if a.Equal(b) || a.EqualFunc(b, nil) {
+		t.Errorf("Equal with default comparison returned true for different slices")
+	}
+
+	blk := a.blocks[0]
+	if !CompareAndSwap(blk, 3, []int{0, 0}, []int{9}, sameLen) || len(blk.Get(3).([]int)) != 1 {
+		t.Errorf("CompareAndSwap with same-length comparator failed, value %v", blk.Get(3))
+	}
+
+	p := ValuePool{Eq: sameLen}
+	h1 := p.Intern([]int{1, 2})
+	h2 := p.Intern([]int{3})
+	if h := p.Intern([]int{7, 8}); h != h1 {
+		t.Errorf("Intern of equal-length slice handle %d != expected %d", h, h1)
+	}
+	if h1 == h2 || len(p.Value(h2).([]int)) != 1 {
+		t.Errorf("Intern handles (%d, %d) for different-length slices", h1, h2)
 	}
 }